@@ -2,21 +2,47 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/bobg/go-generics/v4/slices"
 	"github.com/cynix/freebsd-binaries/build/container"
 	"github.com/cynix/freebsd-binaries/build/packages"
 	"github.com/cynix/freebsd-binaries/build/project"
+	"github.com/cynix/freebsd-binaries/build/registry"
+	"github.com/cynix/freebsd-binaries/build/schema"
 	"github.com/cynix/freebsd-binaries/build/utils"
+	"github.com/cynix/freebsd-binaries/build/version"
 	"github.com/enrichman/gh-iter/v74"
 	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"github.com/goccy/go-yaml/parser"
 	"github.com/google/go-github/v74/github"
 )
 
 type Config struct {
 	Projects map[string]project.Project
+	Settings project.Settings
+
+	sources   map[string]source
+	templates map[string]source
+	settings  *source
+	issues    []Issue
+}
+
+// settingsKey is the top-level key of the settings, which is therefore not
+// available as a project name.
+const settingsKey = "settings"
+
+type source struct {
+	file string
+	node *ast.MappingValueNode
 }
 
 type Matrix struct {
@@ -24,28 +50,87 @@ type Matrix struct {
 }
 
 type MatrixJob struct {
-	Project    string `json:"project"`
-	Version    string `json:"version"`
-	Packages   string `json:"packages"`
-	Containers string `json:"containers"`
+	Project     string `json:"project"`
+	Version     string `json:"version"`
+	Fingerprint string `json:"fingerprint"`
+	Packages    string `json:"packages"`
+	Containers  string `json:"containers"`
+	// Dependencies are the projects rebuilt in earlier stages that the
+	// project depends on, which must have been built for it to be built.
+	Dependencies string `json:"dependencies"`
+	project.Resources
+	// Reasons tells why each container is rebuilt.
+	Reasons map[string]string `json:"reasons,omitempty"`
 }
 
-func (c *Config) Matrix(gh *github.Client, projects []string, force bool) (m Matrix, err error) {
-	projects = slices.Filter(slices.Map(projects, strings.TrimSpace), func(s string) bool { return len(s) > 0 })
-	if len(projects) == 0 {
-		for k := range c.Projects {
-			projects = append(projects, k)
+// MaxStages is the number of matrix stages run by dispatch.yaml, which
+// limits how deep dependencies can be.
+const MaxStages = 3
+
+// matrixWorkers is how many projects Matrix resolves at once.
+const matrixWorkers = 8
+
+// Matrix returns the jobs that build projects, in stages that must be run in
+// order. Unless force is set, packages that are already released with the
+// same fingerprint, and containers whose published image was built from the
+// same inputs, are left out, unless a dependency is rebuilt. So are frozen
+// projects, while disabled ones are left out regardless. Each job lists the
+// dependencies rebuilt in earlier stages, without which it is not built.
+//
+// Upstream versions are looked up in batches where possible, and projects are
+// resolved concurrently.
+func (c *Config) Matrix(core utils.Core, gh *github.Client, reg *registry.Client, selectors []string, force bool) (stages []Matrix, err error) {
+	var projects []string
+	if projects, err = c.Select(selectors); err != nil {
+		return
+	}
+
+	projects = slices.Filter(projects, func(k string) bool {
+		bp := c.Projects[k].Common()
+
+		note := bp.Note
+		if note != "" {
+			note = ": " + note
+		}
+
+		switch bp.State {
+		case project.StateDisabled:
+			core.Info("Skipping disabled project %q%s", k, note)
+			return false
+
+		case project.StateFrozen:
+			if !force {
+				core.Info("Skipping frozen project %q%s", k, note)
+				return false
+			}
+
+		case project.StateDeprecated:
+			core.Warning("Project %q is deprecated%s", k, note)
 		}
+
+		return true
+	})
+
+	var order [][]string
+	if order, err = c.Stages(projects); err != nil {
+		return
 	}
-	slices.Sort(projects)
 
-	existing := make(map[string]struct{})
+	// Fingerprints of existing releases, which are empty for releases made
+	// before they were recorded. Those are taken to be unchanged rather than
+	// all rebuilt at once, and get a fingerprint with their next release.
+	existing := make(map[string]string)
 
 	if !force {
-		releases := ghiter.NewFromFn2(gh.Repositories.ListReleases, "cynix", "freebsd-binaries").Opts(&github.ListOptions{PerPage: 100})
+		releases := ghiter.NewFromFn2(gh.Repositories.ListReleases, c.Settings.Owner(), c.Settings.Repo()).Opts(&github.ListOptions{PerPage: 100})
 
 		for rls := range releases.All() {
-			existing[*rls.TagName] = struct{}{}
+			var fp string
+			if m := fingerprintRegex.FindStringSubmatch(rls.GetBody()); m != nil {
+				fp = m[1]
+			}
+
+			existing[*rls.TagName] = fp
 		}
 
 		if err = releases.Err(); err != nil {
@@ -54,58 +139,367 @@ func (c *Config) Matrix(gh *github.Client, projects []string, force bool) (m Mat
 		}
 	}
 
+	var refs []version.RepoRef
+
 	for _, k := range projects {
-		p, ok := c.Projects[k]
-		if !ok {
-			err = fmt.Errorf("unknown project: %q", k)
-			return
-		}
+		refs = append(refs, c.Projects[k].Sources()...)
+	}
 
-		var j project.ProjectJob
-		if j, err = p.Job(gh); err != nil {
-			return
-		}
+	if err := version.Prefetch(gh, refs); err != nil {
+		core.Warning("Could not prefetch upstream versions, looking them up one by one: %v", err)
+	}
+
+	jobs := make(map[string]MatrixJob)
+	var mu sync.Mutex
+
+	if err = utils.Parallel(core, nil, matrixWorkers, projects, func(core utils.Core, k string) error {
+		mj, err := c.matrixJob(gh, reg, existing, k, force)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		jobs[k] = mj
+		return err
+	}); err != nil {
+		return
+	}
+
+	// Rebuilding a dependency changes the release or image that dependents
+	// are built from, which is not known until it is rebuilt.
+	deps := c.Dependencies()
+
+	for _, stage := range order {
+		for _, k := range stage {
+			mj := jobs[k]
+			var rebuilt []string
+
+			for _, dep := range deps[k] {
+				if dj, ok := jobs[dep]; !ok || (dj.Packages == "" && dj.Containers == "") {
+					continue
+				}
 
-		mj := MatrixJob{Project: j.Project, Version: j.Version}
-		var b []byte
+				rebuilt = append(rebuilt, dep)
 
-		if len(j.Packages) > 0 {
-			if _, ok := existing[fmt.Sprintf("%s-v%s", j.Project, j.Version)]; !ok {
-				if b, err = json.Marshal(j.Packages); err != nil {
+				for _, name := range c.Projects[k].Containers() {
+					if err = mj.rebuild(name, fmt.Sprintf("dependency %q rebuilt", dep)); err != nil {
+						return
+					}
+				}
+			}
+
+			if len(rebuilt) > 0 {
+				var b []byte
+				if b, err = json.Marshal(slices.Sorted(slices.Values(rebuilt))); err != nil {
 					return
 				}
-				mj.Packages = string(b)
+
+				mj.Dependencies = string(b)
 			}
+
+			jobs[k] = mj
+		}
+	}
+
+	for _, k := range projects {
+		for _, name := range slices.Sorted(maps.Keys(jobs[k].Reasons)) {
+			core.Info("Rebuilding container %q: %s", name, jobs[k].Reasons[name])
+		}
+	}
+
+	for _, stage := range order {
+		var m Matrix
+
+		for _, k := range stage {
+			m.Include = append(m.Include, jobs[k])
+		}
+
+		stages = append(stages, m)
+	}
+
+	return
+}
+
+// rebuild adds container name to the job for reason, unless it is already
+// rebuilt.
+func (mj *MatrixJob) rebuild(name, reason string) error {
+	if _, ok := mj.Reasons[name]; ok {
+		return nil
+	}
+
+	var containers []string
+	if mj.Containers != "" {
+		if err := json.Unmarshal([]byte(mj.Containers), &containers); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(append(containers, name))
+	if err != nil {
+		return err
+	}
+
+	mj.Containers = string(b)
+
+	if mj.Reasons == nil {
+		mj.Reasons = make(map[string]string)
+	}
+	mj.Reasons[name] = reason
+
+	return nil
+}
+
+// matrixJob returns the job that builds project k, given the fingerprints of
+// existing releases.
+func (c *Config) matrixJob(gh *github.Client, reg *registry.Client, existing map[string]string, k string, force bool) (mj MatrixJob, err error) {
+	p := c.Projects[k]
+
+	var j project.ProjectJob
+	if j, err = p.Job(gh); err != nil {
+		return
+	}
+
+	mj = MatrixJob{Project: j.Project, Version: j.Version, Resources: p.Common().Resources}
+	var b []byte
+
+	if len(j.Packages) > 0 {
+		if mj.Fingerprint, err = p.Fingerprint(); err != nil {
+			err = fmt.Errorf("could not fingerprint %q: %w", k, err)
+			return
 		}
 
-		if len(j.Containers) > 0 {
-			if b, err = json.Marshal(j.Containers); err != nil {
+		if fp, ok := existing[fmt.Sprintf("%s-v%s", j.Project, j.Version)]; !ok || (fp != "" && fp != mj.Fingerprint) {
+			if b, err = json.Marshal(j.Packages); err != nil {
 				return
 			}
-			mj.Containers = string(b)
+			mj.Packages = string(b)
+		}
+	}
+
+	var containers []string
+
+	for _, name := range j.Containers {
+		reason := "forced"
+		if !force {
+			reason = p.RebuildReason(gh, reg, j.Version, name)
+		}
+
+		if reason != "" {
+			containers = append(containers, name)
+
+			if mj.Reasons == nil {
+				mj.Reasons = make(map[string]string)
+			}
+			mj.Reasons[name] = reason
 		}
+	}
 
-		m.Include = append(m.Include, mj)
+	if len(containers) > 0 {
+		if b, err = json.Marshal(containers); err != nil {
+			return
+		}
+		mj.Containers = string(b)
+	}
+
+	return
+}
+
+// Load reads projects from a file, or from a directory in which every *.yaml
+// file and every <name>/project.yaml file is read.
+func Load(name string) (*Config, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{name}
+
+	if fi.IsDir() {
+		if files, err = configFiles(name); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &Config{}
+	var errs []error
+
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := c.parse(file, b); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", file, err))
+		}
+	}
+
+	return c, errors.Join(append(errs, c.decode())...)
+}
+
+func configFiles(dir string) (files []string, err error) {
+	for _, pattern := range []string{"*.yaml", "*/project.yaml"} {
+		var found []string
+		if found, err = filepath.Glob(filepath.Join(dir, pattern)); err != nil {
+			return
+		}
+
+		for _, file := range found {
+			rel, _ := filepath.Rel(dir, file)
+
+			if !strings.HasPrefix(rel, ".") {
+				files = append(files, file)
+			}
+		}
+	}
+
+	if len(files) == 0 {
+		err = fmt.Errorf("no config files in %q", dir)
 	}
 
 	return
 }
 
 func (c *Config) UnmarshalYAML(b []byte) error {
-	var projects map[string]configProject
+	return errors.Join(c.parse("", b), c.decode())
+}
+
+func (c *Config) JSONSchema(g *schema.Generator) *schema.Schema {
+	return &schema.Schema{
+		Title:                "projects.yaml",
+		Type:                 "object",
+		Properties:           map[string]*schema.Schema{settingsKey: g.Reflect(project.Settings{})},
+		PatternProperties:    map[string]*schema.Schema{`^\.`: {Type: "object", Description: "Template for projects and packages to extend"}},
+		AdditionalProperties: g.Reflect(configProject{}),
+	}
+}
+
+func (c *Config) parse(file string, b []byte) error {
+	f, err := parser.ParseBytes(b, 0)
+	if err != nil {
+		issue := Issue{File: file, Message: err.Error()}
+
+		var ye yaml.Error
+		if errors.As(err, &ye) {
+			issue.Message = ye.GetMessage()
 
-	if err := yaml.UnmarshalWithOptions(b, &projects, yaml.DisallowUnknownField()); err != nil {
+			if tk := ye.GetToken(); tk != nil && tk.Position != nil {
+				issue.Line, issue.Column = tk.Position.Line, tk.Position.Column
+			}
+		}
+
+		c.issues = append(c.issues, issue)
 		return err
 	}
 
-	c.Projects = make(map[string]project.Project)
+	if c.sources == nil {
+		c.sources = make(map[string]source)
+		c.templates = make(map[string]source)
+	}
+
+	var errs []error
+
+	for _, doc := range f.Docs {
+		if doc.Body == nil {
+			continue
+		}
+
+		kvs := mappingValues(doc.Body)
+		if kvs == nil {
+			pos := doc.Body.GetToken().Position
+			c.issues = append(c.issues, Issue{File: file, Line: pos.Line, Column: pos.Column, Message: "expected a mapping of projects"})
+			return fmt.Errorf("%s: expected a mapping of projects", pos)
+		}
+
+		for _, kv := range kvs {
+			name := kv.Key.GetToken().Value
+			src := source{file: file, node: kv}
+
+			if name == settingsKey {
+				if c.settings != nil {
+					err := fmt.Errorf("duplicate settings, also defined in %s", c.settings.file)
+					c.issues = append(c.issues, src.issue(project.Path{name}, err.Error()))
+					errs = append(errs, err)
+					continue
+				}
+
+				c.settings = &src
+				continue
+			}
+
+			sources, kind := c.sources, "project"
+			if strings.HasPrefix(name, ".") {
+				sources, kind = c.templates, "template"
+			}
 
-	for k, v := range projects {
-		v.p.Hydrate(k)
-		c.Projects[k] = v.p
+			if prev, ok := sources[name]; ok {
+				err := fmt.Errorf("duplicate %s: %q", kind, name)
+				if prev.file != file {
+					err = fmt.Errorf("duplicate %s: %q, also defined in %s", kind, name, prev.file)
+				}
+
+				c.issues = append(c.issues, src.issue(project.Path{name}, err.Error()))
+				errs = append(errs, err)
+				continue
+			}
+
+			sources[name] = src
+		}
 	}
 
-	return nil
+	return errors.Join(errs...)
+}
+
+// decode decodes and hydrates every project parsed so far, once all the
+// templates they may extend are known.
+func (c *Config) decode() error {
+	if c.Projects == nil {
+		c.Projects = make(map[string]project.Project)
+	}
+
+	var errs []error
+
+	if c.settings != nil {
+		if err := yaml.NodeToValue(c.settings.node.Value, &c.Settings, yaml.DisallowUnknownField()); err != nil {
+			msg, _, _ := strings.Cut(err.Error(), "\n")
+			msg = relativePositionRegex.ReplaceAllString(msg, "")
+			c.issues = append(c.issues, c.settings.issue(project.Path{settingsKey}, msg))
+			errs = append(errs, fmt.Errorf("invalid settings: %w", err))
+		}
+	}
+
+	c.Settings.Hydrate()
+
+	for _, name := range slices.Sorted(maps.Keys(c.sources)) {
+		if _, ok := c.Projects[name]; ok {
+			continue
+		}
+
+		src := c.sources[name]
+		var cp configProject
+
+		if err := c.decodeProject(src, &cp); err != nil {
+			// Positions in decode errors are relative to the project, so
+			// errors are reported at their path in the source instead.
+			at := project.Path{name}
+
+			var de *decodeError
+			if errors.As(err, &de) {
+				at = append(at, de.path...)
+			}
+
+			msg, _, _ := strings.Cut(err.Error(), "\n")
+			msg = relativePositionRegex.ReplaceAllString(msg, "")
+			msg = typeArgsRegex.ReplaceAllString(msg, "$1")
+			c.issues = append(c.issues, src.issue(at, msg))
+			errs = append(errs, fmt.Errorf("invalid project %q: %w", name, err))
+			continue
+		}
+
+		cp.p.Hydrate(name, c.Settings)
+		c.Projects[name] = cp.p
+	}
+
+	return errors.Join(errs...)
 }
 
 type configProject struct {
@@ -121,22 +515,43 @@ type dummyProject struct {
 	}
 }
 
-func (dp *dummyProject) Hydrate(name string) {
-	dp.Name = name
+func (dp *dummyProject) Hydrate(name string, s project.Settings) {
+	dp.Name, dp.Settings = name, s
+	dp.Resources.Hydrate()
 }
 
 func (dp *dummyProject) Job(gh *github.Client) (project.ProjectJob, error) {
 	return project.ProjectJob{Project: dp.Name}, nil
 }
 
-func (dp *dummyProject) BuildPackage(core utils.Core, gh *github.Client, version, name string) error {
+func (dp *dummyProject) BuildPackage(core utils.Core, gh *github.Client, r utils.Runner, version, name string) error {
 	return fmt.Errorf("cannot build dummy project %q version %q package %q", dp.Name, version, name)
 }
 
-func (dp *dummyProject) BuildContainer(core utils.Core, gh *github.Client, version, name string) error {
+func (dp *dummyProject) BuildContainer(core utils.Core, gh *github.Client, r utils.Runner, version, name string) error {
 	return fmt.Errorf("cannot build dummy project %q version %q container %q", dp.Name, version, name)
 }
 
+func (dp *dummyProject) Fingerprint() (string, error) {
+	return "", nil
+}
+
+func (dp *dummyProject) Containers() []string {
+	return nil
+}
+
+func (dp *dummyProject) Requires() []project.Requirement {
+	return nil
+}
+
+func (dp *dummyProject) RebuildReason(gh *github.Client, reg *registry.Client, version, name string) string {
+	return fmt.Sprintf("cannot build dummy project %q container %q", dp.Name, name)
+}
+
+func (dp *dummyProject) Validate(v *project.Validator, at project.Path) {
+	v.Errorf(at.Key("builder"), "unsupported builder: %q", dp.Builder)
+}
+
 func (cp *configProject) UnmarshalYAML(b []byte) error {
 	var m map[string]any
 
@@ -149,6 +564,12 @@ func (cp *configProject) UnmarshalYAML(b []byte) error {
 		case "cargo":
 			return try[packages.CargoProject](b, &cp.p)
 
+		case "c":
+			return try[packages.CProject](b, &cp.p)
+
+		case "script":
+			return try[packages.ScriptProject](b, &cp.p)
+
 		case "go":
 			fallthrough
 		case "cgo":
@@ -166,6 +587,18 @@ func (cp *configProject) UnmarshalYAML(b []byte) error {
 	return fmt.Errorf("could not determine project type")
 }
 
+// JSONSchema accepts any kind of project. Projects that extend others may
+// leave out what tells the kinds apart, so more than one may match.
+func (cp *configProject) JSONSchema(g *schema.Generator) *schema.Schema {
+	return schema.AnyOf(
+		g.Reflect(container.ContainerProject{}),
+		g.Reflect(packages.GoProject{}),
+		g.Reflect(packages.CargoProject{}),
+		g.Reflect(packages.CProject{}),
+		g.Reflect(packages.ScriptProject{}),
+	)
+}
+
 func try[T any, P interface {
 	*T
 	project.Project
@@ -179,3 +612,11 @@ func try[T any, P interface {
 	*p = P(&t)
 	return nil
 }
+
+var (
+	relativePositionRegex = regexp.MustCompile(`^\[\d+:\d+\]\s*`)
+	// typeArgsRegex matches the type arguments of generic types, such as
+	// those that package projects are built on, in Go field names.
+	typeArgsRegex    = regexp.MustCompile(`(\w)\[[^\]\s]+\]`)
+	fingerprintRegex = regexp.MustCompile(`(?m)^Fingerprint: (\S+)\s*$`)
+)
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/cynix/freebsd-binaries/build/project"
+	"github.com/goccy/go-yaml"
+	"github.com/google/go-github/v74/github"
+)
+
+type Resolved struct {
+	Config   project.Project    `json:"config"`
+	Resolved project.Resolution `json:"resolved"`
+}
+
+// Dump returns the effective config of projects after hydration. If gh is
+// not nil, each project is accompanied by what it resolves to upstream.
+func (c *Config) Dump(gh *github.Client, selectors []string) (map[string]any, error) {
+	projects, err := c.Select(selectors)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]any)
+
+	for _, k := range projects {
+		p := c.Projects[k]
+
+		if gh == nil {
+			m[k] = p
+			continue
+		}
+
+		res, err := p.Resolve(gh)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve %q: %w", k, err)
+		}
+
+		m[k] = Resolved{Config: p, Resolved: res}
+	}
+
+	return m, nil
+}
+
+// Marshal encodes v as YAML or JSON, omitting empty values.
+func Marshal(v any, format string) ([]byte, error) {
+	b, err := yaml.MarshalWithOptions(v, yaml.OmitEmpty(), yaml.OmitZero(), yaml.IndentSequence(true))
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "", "yaml":
+		return b, nil
+
+	case "json":
+		if b, err = yaml.YAMLToJSON(b); err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		if err = json.Indent(&buf, b, "", "  "); err != nil {
+			return nil, err
+		}
+
+		buf.WriteByte('\n')
+		return buf.Bytes(), nil
+	}
+
+	return nil, fmt.Errorf("unknown format: %q", format)
+}
@@ -0,0 +1,245 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/cynix/freebsd-binaries/build/project"
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"github.com/goccy/go-yaml/parser"
+	"github.com/goccy/go-yaml/token"
+)
+
+// decodeError is an error decoding the value at path of a project.
+type decodeError struct {
+	path project.Path
+	err  error
+}
+
+func (e *decodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *decodeError) Unwrap() error {
+	return e.err
+}
+
+// decodeProject decodes a project, after merging in any templates that it
+// or its packages extend.
+//
+// A project or package may extend a template, i.e. a top-level entry whose
+// name starts with ".", or another project, by naming it in extends. When a
+// list is given, later entries take precedence over earlier ones, and the
+// extending entry itself takes precedence over all of them. Mappings are
+// merged recursively, while sequences and scalars are replaced as a whole.
+func (c *Config) decodeProject(src source, cp *configProject) error {
+	var v any
+
+	if err := yaml.NodeToValue(src.node.Value, &v); err != nil {
+		return err
+	}
+
+	if !extends(v) {
+		return decodeYAML([]byte(src.node.Value.String()), cp)
+	}
+
+	v, err := c.extend(v, []string{src.node.Key.GetToken().Value})
+	if err != nil {
+		return err
+	}
+
+	if m, ok := v.(map[string]any); ok {
+		if pkgs, ok := m["packages"].(map[string]any); ok {
+			for k, pkg := range pkgs {
+				if pkgs[k], err = c.extend(pkg, nil); err != nil {
+					return fmt.Errorf("package %q: %w", k, err)
+				}
+			}
+		}
+	}
+
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return decodeYAML(b, cp)
+}
+
+// decodeYAML decodes the project in b. As positions in b are not those in the
+// source, errors are returned as decodeErrors where possible, so that they
+// can be reported at the same path in the source.
+func decodeYAML(b []byte, cp *configProject) error {
+	err := cp.UnmarshalYAML(b)
+
+	var ye yaml.Error
+	if err == nil || !errors.As(err, &ye) || ye.GetToken() == nil {
+		return err
+	}
+
+	f, perr := parser.ParseBytes(b, 0)
+	if perr != nil || len(f.Docs) == 0 || f.Docs[0].Body == nil {
+		return err
+	}
+
+	if at, ok := tokenPath(f.Docs[0].Body, ye.GetToken(), nil); ok {
+		return &decodeError{at, err}
+	}
+
+	return err
+}
+
+// tokenPath returns the path to the key or value of n at the same position as
+// tk. Tokens of nested documents, which some types decode themselves, are
+// only found if they also have the same value.
+func tokenPath(n ast.Node, tk *token.Token, at project.Path) (project.Path, bool) {
+	if sameToken(n.GetToken(), tk) {
+		return at, true
+	}
+
+	if seq, ok := unwrap(n).(*ast.SequenceNode); ok {
+		for i, v := range seq.Values {
+			if p, ok := tokenPath(v, tk, at.Index(i)); ok {
+				return p, true
+			}
+		}
+	}
+
+	for _, kv := range mappingValues(n) {
+		key := kv.Key.GetToken().Value
+
+		if sameToken(kv.Key.GetToken(), tk) {
+			return at.Key(key), true
+		}
+
+		if p, ok := tokenPath(kv.Value, tk, at.Key(key)); ok {
+			return p, true
+		}
+	}
+
+	return nil, false
+}
+
+func sameToken(a, b *token.Token) bool {
+	return a != nil && b != nil && a.Value == b.Value && a.Position.Line == b.Position.Line && a.Position.Column == b.Position.Column
+}
+
+// extend returns v merged on top of the entries it extends.
+func (c *Config) extend(v any, seen []string) (any, error) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return v, nil
+	}
+
+	ext, ok := m["extends"]
+	if !ok {
+		return v, nil
+	}
+
+	var names []string
+
+	switch x := ext.(type) {
+	case string:
+		names = []string{x}
+
+	case []any:
+		for _, name := range x {
+			s, ok := name.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid extends: %v", ext)
+			}
+			names = append(names, s)
+		}
+
+	default:
+		return nil, fmt.Errorf("invalid extends: %v", ext)
+	}
+
+	var base any
+
+	for _, name := range names {
+		if slices.Contains(seen, name) {
+			return nil, fmt.Errorf("cyclic extends: %s", strings.Join(append(seen, name), " -> "))
+		}
+
+		src, ok := c.templates[name]
+		if !ok {
+			if src, ok = c.sources[name]; !ok {
+				return nil, fmt.Errorf("unknown template: %q", name)
+			}
+		}
+
+		var t any
+
+		if err := yaml.NodeToValue(src.node.Value, &t); err != nil {
+			return nil, fmt.Errorf("invalid template %q: %w", name, err)
+		}
+
+		if _, ok := t.(map[string]any); !ok {
+			return nil, fmt.Errorf("template %q is not a mapping", name)
+		}
+
+		t, err := c.extend(t, append(seen, name))
+		if err != nil {
+			return nil, err
+		}
+
+		base = merge(base, t)
+	}
+
+	own := maps.Clone(m)
+	delete(own, "extends")
+
+	return merge(base, own), nil
+}
+
+// extends reports whether a project or any of its packages extends anything.
+func extends(v any) bool {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return false
+	}
+
+	if _, ok := m["extends"]; ok {
+		return true
+	}
+
+	pkgs, _ := m["packages"].(map[string]any)
+
+	for _, pkg := range pkgs {
+		if p, ok := pkg.(map[string]any); ok {
+			if _, ok := p["extends"]; ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func merge(dst, src any) any {
+	d, ok := dst.(map[string]any)
+	if !ok {
+		return src
+	}
+
+	s, ok := src.(map[string]any)
+	if !ok {
+		return src
+	}
+
+	out := maps.Clone(d)
+
+	for k, v := range s {
+		if prev, ok := out[k]; ok {
+			v = merge(prev, v)
+		}
+		out[k] = v
+	}
+
+	return out
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Dependencies returns the projects that each project must be built after,
+// as inferred from the releases of this repo and the images built by this
+// repo that its containers are built from.
+func (c *Config) Dependencies() map[string][]string {
+	images := make(map[string]string)
+
+	for k, p := range c.Projects {
+		for _, name := range p.Containers() {
+			images[name] = k
+		}
+	}
+
+	deps := make(map[string][]string)
+	prefix := c.Settings.Registry + "/"
+
+	for k, p := range c.Projects {
+		found := make(map[string]struct{})
+
+		for _, req := range p.Requires() {
+			switch {
+			case req.Image != "":
+				repo, _, _ := strings.Cut(strings.TrimPrefix(req.Image, prefix), ":")
+				if dep, ok := images[repo]; ok && strings.HasPrefix(req.Image, prefix) {
+					found[dep] = struct{}{}
+				}
+
+			case req.Repo != c.Settings.Release:
+				// Not released by this repo.
+
+			case req.Tag != "" && req.Tag != "@":
+				if dep := c.tagProject(req.Tag); dep != "" {
+					found[dep] = struct{}{}
+				}
+
+			case req.Regex != nil:
+				for dep := range c.Projects {
+					if req.Regex.MatchString(dep + "-v0.0.0") {
+						found[dep] = struct{}{}
+					}
+				}
+			}
+		}
+
+		delete(found, k)
+
+		if len(found) > 0 {
+			deps[k] = slices.Sorted(maps.Keys(found))
+		}
+	}
+
+	return deps
+}
+
+// tagProject returns the project that a release tag belongs to. Project names
+// may themselves contain "-v", so the longest match is preferred.
+func (c *Config) tagProject(tag string) (prj string) {
+	for k := range c.Projects {
+		if strings.HasPrefix(tag, k+"-v") && len(k) > len(prj) {
+			prj = k
+		}
+	}
+
+	return
+}
+
+// Stages sorts projects into stages, so that each project only depends on
+// projects in earlier stages. Dependencies on other projects are ignored.
+func (c *Config) Stages(projects []string) ([][]string, error) {
+	deps := c.Dependencies()
+	pending := make(map[string][]string)
+
+	for _, k := range projects {
+		pending[k] = slices.DeleteFunc(slices.Clone(deps[k]), func(dep string) bool {
+			return !slices.Contains(projects, dep)
+		})
+	}
+
+	var stages [][]string
+
+	for len(pending) > 0 {
+		var stage []string
+
+		for k, deps := range pending {
+			if len(deps) == 0 {
+				stage = append(stage, k)
+			}
+		}
+
+		if len(stage) == 0 {
+			return nil, fmt.Errorf("dependency cycle: %s", strings.Join(cycle(pending), " -> "))
+		}
+
+		slices.Sort(stage)
+
+		for _, k := range stage {
+			delete(pending, k)
+		}
+
+		for k, deps := range pending {
+			pending[k] = slices.DeleteFunc(deps, func(dep string) bool {
+				return slices.Contains(stage, dep)
+			})
+		}
+
+		stages = append(stages, stage)
+	}
+
+	return stages, nil
+}
+
+// cycle returns a cycle in deps, in which every project has dependencies.
+func cycle(deps map[string][]string) []string {
+	k := slices.Sorted(maps.Keys(deps))[0]
+	var path []string
+
+	for !slices.Contains(path, k) {
+		path = append(path, k)
+		k = deps[k][0]
+	}
+
+	return append(path[slices.Index(path, k):], k)
+}
@@ -0,0 +1,239 @@
+package config
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/bobg/go-generics/v4/slices"
+	"github.com/cynix/freebsd-binaries/build/container"
+	"github.com/cynix/freebsd-binaries/build/registry"
+	"github.com/enrichman/gh-iter/v74"
+	"github.com/google/go-github/v74/github"
+)
+
+type Status struct {
+	Project   string    `json:"project"`
+	Published string    `json:"published,omitempty"`
+	Upstream  string    `json:"upstream,omitempty"`
+	Date      time.Time `json:"date,omitzero"`
+	Days      int       `json:"days_behind"`
+	Commits   int       `json:"commits_behind,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type Report []Status
+
+func (s Status) Outdated() bool {
+	return s.Error == "" && s.Upstream != "" && (s.Published != s.Upstream || s.Commits > 0)
+}
+
+// Outdated compares the upstream version of each project with the latest
+// published release, or for container projects the image tagged latest.
+// Failures to check a single project are recorded in its Status.
+func (c *Config) Outdated(gh *github.Client, reg *registry.Client, selectors []string, now time.Time) (r Report, err error) {
+	var projects []string
+	if projects, err = c.Select(selectors); err != nil {
+		return
+	}
+
+	var published map[string]release
+	if published, err = c.latestReleases(gh); err != nil {
+		return
+	}
+
+	for _, k := range projects {
+		p := c.Projects[k]
+		s := Status{Project: k}
+
+		if _, ok := p.(*container.ContainerProject); ok {
+			var err2 error
+			if s.Published, err2 = publishedImage(reg, c.Settings.Repository(k)); err2 != nil {
+				s.Error = err2.Error()
+			}
+		} else if rls, ok := published[k]; ok {
+			s.Published = rls.version.Original()
+		}
+
+		up, err2 := p.Upstream(gh)
+		if err2 != nil {
+			s.Error = err2.Error()
+		}
+
+		s.Upstream, s.Date, s.Commits = up.Version, up.Date, up.Commits
+
+		if s.Outdated() && !s.Date.IsZero() {
+			s.Days = int(now.Sub(s.Date).Hours() / 24)
+		}
+
+		r = append(r, s)
+	}
+
+	return
+}
+
+// release is the latest published release of a project.
+type release struct {
+	version *semver.Version
+	*github.RepositoryRelease
+}
+
+// latestReleases returns the latest published release of each project, by
+// semver rather than by date.
+func (c *Config) latestReleases(gh *github.Client) (map[string]release, error) {
+	published := make(map[string]release)
+	releases := ghiter.NewFromFn2(gh.Repositories.ListReleases, c.Settings.Owner(), c.Settings.Repo()).Opts(&github.ListOptions{PerPage: 100})
+
+	for rls := range releases.All() {
+		var prj, ver string
+
+		// Project names may themselves contain "-v", so prefer the longest.
+		for k := range c.Projects {
+			if v, ok := strings.CutPrefix(rls.GetTagName(), k+"-v"); ok && len(k) > len(prj) {
+				prj, ver = k, v
+			}
+		}
+
+		sv, err := semver.NewVersion(ver)
+		if prj == "" || err != nil {
+			continue
+		}
+
+		if cur, ok := published[prj]; !ok || sv.GreaterThan(cur.version) {
+			published[prj] = release{sv, rls}
+		}
+	}
+
+	if err := releases.Err(); err != nil {
+		return nil, fmt.Errorf("could not list current releases: %w", err)
+	}
+
+	return published, nil
+}
+
+// publishedImage finds the version tag that points at the same image as
+// latest.
+func publishedImage(reg *registry.Client, repo string) (string, error) {
+	latest, err := reg.Digest(repo, "latest")
+	if err != nil {
+		return "", err
+	}
+
+	tags, err := reg.Tags(repo)
+	if err != nil {
+		return "", err
+	}
+
+	// Check the newest looking tags first.
+	slices.SortFunc(tags, func(a, b string) int {
+		va, erra := semver.NewVersion(a)
+		vb, errb := semver.NewVersion(b)
+
+		switch {
+		case erra == nil && errb == nil:
+			return vb.Compare(va)
+		case erra == nil:
+			return -1
+		case errb == nil:
+			return 1
+		}
+
+		return strings.Compare(b, a)
+	})
+
+	for _, tag := range tags {
+		if tag == "latest" {
+			continue
+		}
+
+		if digest, err := reg.Digest(repo, tag); err == nil && digest == latest {
+			return tag, nil
+		}
+	}
+
+	return "latest", nil
+}
+
+func (r Report) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROJECT\tPUBLISHED\tUPSTREAM\tBEHIND")
+
+	for _, s := range r {
+		behind := "-"
+
+		switch {
+		case s.Error != "":
+			behind = "error: " + s.Error
+		case s.Commits > 0:
+			behind = fmt.Sprintf("%d commits, %d days", s.Commits, s.Days)
+		case s.Outdated():
+			behind = fmt.Sprintf("%d days", s.Days)
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.Project, cmp.Or(s.Published, "-"), cmp.Or(s.Upstream, "?"), behind)
+	}
+
+	return tw.Flush()
+}
+
+// WritePrometheus writes r in the text exposition format, for the node
+// exporter's textfile collector.
+func (r Report) WritePrometheus(w io.Writer, now time.Time) error {
+	var sb strings.Builder
+
+	sb.WriteString("# HELP freebsd_binaries_version_info Published and upstream versions.\n# TYPE freebsd_binaries_version_info gauge\n")
+
+	for _, s := range r {
+		fmt.Fprintf(&sb, "freebsd_binaries_version_info{project=%s,published=%s,upstream=%s} 1\n", label(s.Project), label(s.Published), label(s.Upstream))
+	}
+
+	metrics := []struct {
+		name  string
+		help  string
+		value func(Status) (float64, bool)
+	}{
+		{"outdated", "Whether the published version is behind upstream.", func(s Status) (float64, bool) {
+			return b2f(s.Outdated()), s.Error == ""
+		}},
+		{"days_behind", "Days since the oldest unpublished upstream change.", func(s Status) (float64, bool) {
+			return float64(s.Days), s.Error == ""
+		}},
+		{"commits_behind", "Commits made upstream since a pinned commit.", func(s Status) (float64, bool) {
+			return float64(s.Commits), s.Error == ""
+		}},
+		{"check_error", "Whether the project could not be checked.", func(s Status) (float64, bool) {
+			return b2f(s.Error != ""), true
+		}},
+	}
+
+	for _, m := range metrics {
+		fmt.Fprintf(&sb, "# HELP freebsd_binaries_%s %s\n# TYPE freebsd_binaries_%s gauge\n", m.name, m.help, m.name)
+
+		for _, s := range r {
+			if v, ok := m.value(s); ok {
+				fmt.Fprintf(&sb, "freebsd_binaries_%s{project=%s} %g\n", m.name, label(s.Project), v)
+			}
+		}
+	}
+
+	sb.WriteString("# HELP freebsd_binaries_outdated_timestamp_seconds When the report was generated.\n# TYPE freebsd_binaries_outdated_timestamp_seconds gauge\n")
+	fmt.Fprintf(&sb, "freebsd_binaries_outdated_timestamp_seconds %d\n", now.Unix())
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func label(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func b2f(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
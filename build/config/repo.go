@@ -0,0 +1,70 @@
+package config
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bobg/go-generics/v4/slices"
+	"github.com/cynix/freebsd-binaries/build/packages"
+	"github.com/cynix/freebsd-binaries/build/project"
+	"github.com/cynix/freebsd-binaries/build/utils"
+	"github.com/google/go-github/v74/github"
+)
+
+// Repo creates a pkg repository in dir for each supported ABI, from the pkg
+// packages of the latest published release of each project. The repositories
+// are signed with key unless it is nil. Packages are downloaded with client.
+func (c *Config) Repo(core utils.Core, gh *github.Client, client *http.Client, dir string, key *rsa.PrivateKey) error {
+	repo := packages.PkgRepo{Dir: dir, Key: key}
+
+	for _, arch := range project.SupportedArchs {
+		abi, err := project.PkgABI(c.Settings.FreeBSD, arch)
+		if err != nil {
+			return err
+		}
+
+		repo.ABIs = append(repo.ABIs, abi)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	published, err := c.latestReleases(gh)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range slices.Sorted(maps.Keys(published)) {
+		rls := published[k]
+
+		for _, a := range rls.Assets {
+			if !strings.HasSuffix(a.GetName(), ".pkg") {
+				continue
+			}
+
+			if err := core.Group(fmt.Sprintf("Adding %q from %q", a.GetName(), rls.GetTagName()), func() error {
+				return c.addPkg(core, gh, client, &repo, a)
+			}); err != nil {
+				return fmt.Errorf("could not add %q: %w", a.GetName(), err)
+			}
+		}
+	}
+
+	return repo.Write(core)
+}
+
+func (c *Config) addPkg(core utils.Core, gh *github.Client, client *http.Client, repo *packages.PkgRepo, a *github.ReleaseAsset) error {
+	rc, _, err := gh.Repositories.DownloadReleaseAsset(context.TODO(), c.Settings.Owner(), c.Settings.Repo(), a.GetID(), client)
+	if err != nil {
+		return fmt.Errorf("could not download %q: %w", a.GetName(), err)
+	}
+	defer rc.Close()
+
+	return repo.Add(core, a.GetName(), rc)
+}
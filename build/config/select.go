@@ -0,0 +1,143 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"path"
+	"strings"
+
+	"github.com/bobg/go-generics/v4/slices"
+	"github.com/cynix/freebsd-binaries/build/container"
+	"github.com/cynix/freebsd-binaries/build/packages"
+	"github.com/cynix/freebsd-binaries/build/project"
+)
+
+// Select returns the sorted names of the projects picked by selectors, all
+// projects if there are none. Each selector is one of:
+//
+//   - all
+//   - a project name, or a glob of names such as victoria-*
+//   - label=<label>
+//   - builder=<builder>, where container projects have builder container
+//   - has=container or has=package
+//
+// A selector prefixed with ! removes the projects it picks, from all projects
+// if no selector adds any.
+func (c *Config) Select(selectors []string) ([]string, error) {
+	selectors = slices.Filter(slices.Map(selectors, strings.TrimSpace), func(s string) bool { return len(s) > 0 })
+
+	picked := make(map[string]struct{})
+	var excluded []string
+
+	for _, sel := range selectors {
+		sel, negated := strings.CutPrefix(sel, "!")
+
+		matched, err := c.match(sel)
+		if err != nil {
+			return nil, err
+		}
+
+		if negated {
+			excluded = append(excluded, matched...)
+			continue
+		}
+
+		for _, k := range matched {
+			picked[k] = struct{}{}
+		}
+	}
+
+	if len(picked) == 0 && !slices.ContainsFunc(selectors, func(s string) bool { return !strings.HasPrefix(s, "!") }) {
+		for k := range c.Projects {
+			picked[k] = struct{}{}
+		}
+	}
+
+	for _, k := range excluded {
+		delete(picked, k)
+	}
+
+	return slices.Sorted(maps.Keys(picked)), nil
+}
+
+// match returns the projects picked by a single selector.
+func (c *Config) match(sel string) (matched []string, err error) {
+	if sel == "all" {
+		return slices.Collect(maps.Keys(c.Projects)), nil
+	}
+
+	key, value, ok := strings.Cut(sel, "=")
+	if !ok {
+		if _, ok := c.Projects[sel]; ok {
+			return []string{sel}, nil
+		}
+
+		if _, err = path.Match(sel, ""); err != nil {
+			return nil, fmt.Errorf("invalid selector %q: %w", sel, err)
+		}
+
+		for k := range c.Projects {
+			if ok, _ := path.Match(sel, k); ok {
+				matched = append(matched, k)
+			}
+		}
+
+		if len(matched) == 0 {
+			return nil, fmt.Errorf("unknown project: %q", sel)
+		}
+
+		return
+	}
+
+	var pred func(p project.Project) bool
+
+	switch key {
+	case "label":
+		pred = func(p project.Project) bool { return slices.Contains(p.Common().Labels, value) }
+
+	case "builder":
+		pred = func(p project.Project) bool { return builder(p) == value }
+
+	case "has":
+		switch value {
+		case "container":
+			pred = func(p project.Project) bool { return len(p.Containers()) > 0 }
+		case "package":
+			pred = func(p project.Project) bool { return builder(p) != "container" }
+		default:
+			return nil, fmt.Errorf("invalid selector %q: expected has=container or has=package", sel)
+		}
+
+	default:
+		return nil, fmt.Errorf("invalid selector %q: unknown key %q", sel, key)
+	}
+
+	for k, p := range c.Projects {
+		if pred(p) {
+			matched = append(matched, k)
+		}
+	}
+
+	return
+}
+
+// builder returns the builder of a project, which is container for container
+// projects.
+func builder(p project.Project) string {
+	switch x := p.(type) {
+	case *container.ContainerProject:
+		return "container"
+	case *packages.GoProject:
+		return x.Builder
+	case *packages.CargoProject:
+		return x.Builder
+	case *packages.CProject:
+		return x.Builder
+	case *packages.ScriptProject:
+		return x.Builder
+	case *dummyProject:
+		return x.Builder
+	}
+
+	return ""
+}
@@ -0,0 +1,188 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/cynix/freebsd-binaries/build/project"
+	"github.com/goccy/go-yaml/ast"
+)
+
+type Issue struct {
+	File    string
+	Line    int
+	Column  int
+	Path    project.Path
+	Message string
+}
+
+func (i Issue) String() string {
+	var sb strings.Builder
+
+	if i.File != "" {
+		sb.WriteString(i.File)
+		sb.WriteString(":")
+	}
+
+	if i.Line > 0 {
+		fmt.Fprintf(&sb, "%d:%d:", i.Line, i.Column)
+	}
+
+	if sb.Len() > 0 {
+		sb.WriteString(" ")
+	}
+
+	if len(i.Path) > 0 {
+		sb.WriteString(i.Path.String())
+		sb.WriteString(": ")
+	}
+
+	sb.WriteString(i.Message)
+	return sb.String()
+}
+
+// Validate checks every project for problems that would otherwise only
+// surface during a build. It does not access the network.
+func (c *Config) Validate(dir string) []Issue {
+	issues := slices.Clone(c.issues)
+	v := &project.Validator{}
+	c.Settings.Validate(v, project.Path{settingsKey})
+
+	for _, k := range slices.Sorted(maps.Keys(c.Projects)) {
+		c.Projects[k].Validate(v, project.Path{k})
+	}
+
+	v.CheckUsers()
+
+	if stages, err := c.Stages(slices.Collect(maps.Keys(c.Projects))); err != nil {
+		issues = append(issues, Issue{Message: err.Error()})
+	} else if len(stages) > MaxStages {
+		issues = append(issues, Issue{Message: fmt.Sprintf("too many dependency levels: %d > %d, deepest: %s", len(stages), MaxStages, strings.Join(stages[len(stages)-1], ", "))})
+	}
+
+	for _, p := range v.Problems {
+		if src, ok := c.sources[p.Path[0]]; ok {
+			issues = append(issues, src.issue(p.Path, p.Message))
+		} else if p.Path[0] == settingsKey && c.settings != nil {
+			issues = append(issues, c.settings.issue(p.Path, p.Message))
+		} else {
+			issues = append(issues, Issue{Path: p.Path, Message: p.Message})
+		}
+	}
+
+	return append(issues, validateDirs(dir, v)...)
+}
+
+func validateDirs(dir string, v *project.Validator) (issues []Issue) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return []Issue{{File: dir, Message: err.Error()}}
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+
+		name := e.Name()
+
+		if fi, err := os.Stat(filepath.Join(dir, name, "root")); err == nil {
+			if _, ok := v.Roots[name]; !ok {
+				issues = append(issues, Issue{File: filepath.Join(dir, name, "root"), Message: fmt.Sprintf("no container named %q uses this overlay", name)})
+			} else if !fi.IsDir() {
+				issues = append(issues, Issue{File: filepath.Join(dir, name, "root"), Message: "not a directory"})
+			}
+		}
+
+		patches, _ := filepath.Glob(filepath.Join(dir, name, "*.patch"))
+
+		for _, patch := range patches {
+			if _, ok := v.Patched[name]; !ok {
+				issues = append(issues, Issue{File: patch, Message: fmt.Sprintf("no package project named %q applies this patch", name)})
+				continue
+			}
+
+			if b, err := os.ReadFile(patch); err != nil {
+				issues = append(issues, Issue{File: patch, Message: err.Error()})
+			} else if !strings.Contains(string(b), "\n+++ ") && !strings.HasPrefix(string(b), "+++ ") {
+				issues = append(issues, Issue{File: patch, Message: "not a unified diff"})
+			}
+		}
+	}
+
+	return
+}
+
+func (s source) issue(at project.Path, msg string) Issue {
+	i := Issue{File: s.file, Path: at, Message: msg}
+	pos := s.node.Key.GetToken().Position
+	var node ast.Node = s.node.Value
+
+	// Find the closest node that still exists in the source, since some
+	// values are filled in by Hydrate.
+	for _, seg := range at[min(1, len(at)):] {
+		if strings.HasPrefix(seg, "[") {
+			seq, ok := unwrap(node).(*ast.SequenceNode)
+			if !ok {
+				break
+			}
+
+			idx, err := strconv.Atoi(strings.Trim(seg, "[]"))
+			if err != nil || idx < 0 || idx >= len(seq.Values) {
+				break
+			}
+
+			node = seq.Values[idx]
+			pos = node.GetToken().Position
+			continue
+		}
+
+		var next *ast.MappingValueNode
+
+		for _, kv := range mappingValues(node) {
+			if kv.Key.GetToken().Value == seg {
+				next = kv
+				break
+			}
+		}
+
+		if next == nil {
+			break
+		}
+
+		node = next.Value
+		pos = next.Key.GetToken().Position
+	}
+
+	i.Line, i.Column = pos.Line, pos.Column
+	return i
+}
+
+func unwrap(n ast.Node) ast.Node {
+	for {
+		switch x := n.(type) {
+		case *ast.AnchorNode:
+			n = x.Value
+		case *ast.TagNode:
+			n = x.Value
+		default:
+			return n
+		}
+	}
+}
+
+func mappingValues(n ast.Node) []*ast.MappingValueNode {
+	switch x := unwrap(n).(type) {
+	case *ast.MappingNode:
+		return x.Values
+	case *ast.MappingValueNode:
+		return []*ast.MappingValueNode{x}
+	}
+
+	return nil
+}
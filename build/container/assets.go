@@ -14,6 +14,8 @@ import (
 	"strings"
 
 	"github.com/bmatcuk/doublestar/v4"
+	"github.com/cynix/freebsd-binaries/build/project"
+	"github.com/cynix/freebsd-binaries/build/schema"
 	"github.com/cynix/freebsd-binaries/build/utils"
 	"github.com/cynix/freebsd-binaries/build/version"
 	"github.com/goccy/go-yaml"
@@ -59,6 +61,12 @@ type containerInfo struct {
 	FreeBSD string
 	Arch    string
 	Triple  string
+	Inputs  string
+	Base    string
+
+	Deprecated string
+
+	settings project.Settings
 }
 
 type assetInfo struct {
@@ -69,13 +77,15 @@ type assetInfo struct {
 
 type Deployable interface {
 	Deploy(core utils.Core, gh *github.Client, r utils.Runner, mnt, root string, info containerInfo) (assetInfo, error)
+	Resolve(gh *github.Client, info containerInfo) (project.ResolvedAsset, error)
+	Validate(v *project.Validator, at project.Path)
 }
 
 type Asset struct {
 	Deployable
 }
 
-func (ua URLAsset) do(core utils.Core, info containerInfo, v func() (string, error), f func(filename, version string, r io.Reader) error) error {
+func (ua URLAsset) do(core utils.Core, r utils.Runner, info containerInfo, v func() (string, error), f func(filename, version string, r io.Reader) error) error {
 	if info.Version == "" {
 		ver, err := v()
 		if err != nil {
@@ -92,27 +102,62 @@ func (ua URLAsset) do(core utils.Core, info containerInfo, v func() (string, err
 	}
 
 	return core.Group(fmt.Sprintf("Deploying %q", u), func() error {
-		r, err := http.Get(u)
-		if err != nil {
-			return err
-		}
-		defer r.Body.Close()
+		return utils.Perform(r, utils.Step{Action: "download", Target: u}, func() error {
+			resp, err := http.Get(u)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
 
-		if r.StatusCode >= 400 {
-			return fmt.Errorf("could not download %q: %v", u, r.Status)
-		}
+			if resp.StatusCode >= 400 {
+				return fmt.Errorf("could not download %q: %v", u, resp.Status)
+			}
 
-		return f(path.Base(uu.Path), info.Version, r.Body)
+			return f(path.Base(uu.Path), info.Version, resp.Body)
+		})
 	})
 }
 
+func (ua URLAsset) resolve(info containerInfo, v func() (string, error)) (ra project.ResolvedAsset, err error) {
+	if info.Version == "" {
+		if info.Version, err = v(); err != nil {
+			return
+		}
+	}
+
+	ra.Version = info.Version
+	ra.URL = info.Apply(ua.URL)
+	return
+}
+
+// requires returns the release that the URL points to, if it is on GitHub or
+// the configured GitHub server.
+func (ua URLAsset) requires(info containerInfo) []project.Requirement {
+	u, err := url.Parse(info.Apply(ua.URL))
+	if err != nil {
+		return nil
+	}
+
+	if server, err := url.Parse(info.settings.GitHub.Server); u.Host != "github.com" && (err != nil || u.Host != server.Host) {
+		return nil
+	}
+
+	// /{owner}/{repo}/releases/download/{tag}/{name}
+	parts := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+	if len(parts) < 6 || parts[2] != "releases" || parts[3] != "download" {
+		return nil
+	}
+
+	return []project.Requirement{{Repo: parts[0] + "/" + parts[1], Tag: parts[4]}}
+}
+
 func (aa ArchiveAsset) Deploy(core utils.Core, gh *github.Client, r utils.Runner, mnt, root string, info containerInfo) (ai assetInfo, err error) {
 	if len(aa.Files) == 0 {
 		err = fmt.Errorf("no files specified for %q", aa.URL)
 		return
 	}
 
-	err = aa.do(core, info, aa.Version.Resolve, func(filename, version string, body io.Reader) error {
+	err = aa.do(core, r, info, aa.Version.Resolve, func(filename, version string, body io.Reader) error {
 		format, stream, err := archives.Identify(context.TODO(), filename, body)
 		if err != nil {
 			return err
@@ -278,13 +323,33 @@ func (aa ArchiveAsset) Deploy(core utils.Core, gh *github.Client, r utils.Runner
 	return
 }
 
-func (aa *ArchiveAsset) UnmarshalYAML(b []byte) error {
-	var raw struct {
-		Archive string
-		Version version.VersionConfig
-		Files   []ArchiveFile
+func (aa ArchiveAsset) Resolve(gh *github.Client, info containerInfo) (project.ResolvedAsset, error) {
+	return aa.resolve(info, aa.Version.Resolve)
+}
+
+func (aa ArchiveAsset) Validate(v *project.Validator, at project.Path) {
+	aa.URLAsset.validate(v, at.Key("archive"))
+
+	if len(aa.Files) == 0 {
+		v.Errorf(at, "no files specified for %q", aa.URL)
 	}
 
+	validateFiles(v, at.Key("files"), aa.Files)
+}
+
+type rawArchiveAsset struct {
+	Archive string
+	Version version.VersionConfig
+	Files   []ArchiveFile
+}
+
+func (aa ArchiveAsset) MarshalYAML() (any, error) {
+	return rawArchiveAsset{aa.URL, aa.Version, aa.Files}, nil
+}
+
+func (aa *ArchiveAsset) UnmarshalYAML(b []byte) error {
+	var raw rawArchiveAsset
+
 	if err := yaml.UnmarshalWithOptions(b, &raw, yaml.DisallowUnknownField()); err != nil {
 		return err
 	}
@@ -296,7 +361,7 @@ func (aa *ArchiveAsset) UnmarshalYAML(b []byte) error {
 }
 
 func (fa FileAsset) Deploy(core utils.Core, gh *github.Client, r utils.Runner, mnt, root string, info containerInfo) (ai assetInfo, err error) {
-	err = fa.do(core, info, fa.Version.Resolve, func(filename, version string, body io.Reader) error {
+	err = fa.do(core, r, info, fa.Version.Resolve, func(filename, version string, body io.Reader) error {
 		if fa.Dst == "" {
 			fa.Dst = "/usr/local/{package}/"
 		}
@@ -329,11 +394,39 @@ func (fa FileAsset) Deploy(core utils.Core, gh *github.Client, r utils.Runner, m
 	return
 }
 
-func (fa *FileAsset) UnmarshalYAML(b []byte) error {
-	var raw struct {
+func (fa FileAsset) Resolve(gh *github.Client, info containerInfo) (project.ResolvedAsset, error) {
+	return fa.resolve(info, fa.Version.Resolve)
+}
+
+func (fa FileAsset) Validate(v *project.Validator, at project.Path) {
+	fa.URLAsset.validate(v, at.Key("file"))
+
+	if fa.Dst != "" {
+		v.Placeholders(at, fa.Dst, assetPlaceholders...)
+
+		if !strings.HasPrefix(fa.Dst, "/") {
+			v.Errorf(at, "destination is not absolute: %q", fa.Dst)
+		}
+	}
+}
+
+type rawFileAsset struct {
+	File    string
+	Version version.VersionConfig
+}
+
+// MarshalYAML includes the destination filled in by Hydrate, even though it
+// cannot be configured.
+func (fa FileAsset) MarshalYAML() (any, error) {
+	return struct {
 		File    string
 		Version version.VersionConfig
-	}
+		Dst     string
+	}{fa.URL, fa.Version, fa.Dst}, nil
+}
+
+func (fa *FileAsset) UnmarshalYAML(b []byte) error {
+	var raw rawFileAsset
 
 	if err := yaml.UnmarshalWithOptions(b, &raw, yaml.DisallowUnknownField()); err != nil {
 		return err
@@ -352,14 +445,12 @@ func (pa PkgAsset) Deploy(core utils.Core, gh *github.Client, r utils.Runner, mn
 		return
 	}
 
-	machine := info.Arch
-	if machine == "arm64" {
-		machine = "aarch64"
+	abi, err := project.PkgABI(freebsd, info.Arch)
+	if err != nil {
+		return
 	}
 
-	rep := strings.NewReplacer("{major}", major, "{minor}", minor, "{machine}", machine)
-	abi := rep.Replace("FreeBSD:{major}:{machine}")
-	osv := rep.Replace("{major}0{minor}000")
+	osv := fmt.Sprintf("%s0%s000", major, minor)
 
 	if err = core.Group(fmt.Sprintf("Installing packages: %q", pa.Pkgs), func() error {
 		return pa.pkg(r, abi, osv, root, "install", pa.Pkgs...).Run()
@@ -384,11 +475,12 @@ func (pa PkgAsset) Deploy(core utils.Core, gh *github.Client, r utils.Runner, mn
 		core.Warning("could not query package versions: %v", err2)
 	}
 
-	if err2 := os.RemoveAll(path.Join(mnt, root, "/var/cache/pkg")); err2 != nil {
-		core.Warning("Could not clean up /var/cache/pkg: %v", err2)
-	}
-	if err2 := os.RemoveAll(path.Join(mnt, root, "/var/db/pkg")); err2 != nil {
-		core.Warning("Could not clean up /var/db/pkg: %v", err2)
+	for _, dir := range []string{"/var/cache/pkg", "/var/db/pkg"} {
+		if err2 := utils.Perform(r, utils.Step{Action: "remove", Target: path.Join(root, dir)}, func() error {
+			return os.RemoveAll(path.Join(mnt, root, dir))
+		}); err2 != nil {
+			core.Warning("Could not clean up %s: %v", dir, err2)
+		}
 	}
 
 	hints := map[string]struct{}{"/lib": {}, "/usr/lib": {}, "/usr/local/lib": {}}
@@ -415,14 +507,18 @@ func (pa PkgAsset) Deploy(core utils.Core, gh *github.Client, r utils.Runner, mn
 	// Since we run `ldconfig` on the host to modify the container,
 	// the given dirs must exist on the host too.
 	for dir := range hints {
-		if err = os.MkdirAll(path.Join(mnt, dir), 0o755); err != nil {
-			return
-		}
-
 		dirs = append(dirs, dir)
 	}
 	slices.Sort(dirs)
 
+	for _, dir := range dirs {
+		if err = utils.Perform(r, utils.Step{Action: "mkdir", Target: dir}, func() error {
+			return os.MkdirAll(path.Join(mnt, dir), 0o755)
+		}); err != nil {
+			return
+		}
+	}
+
 	if err = r.Command("ldconfig", append([]string{"-f", path.Join(root, "/var/run/ld-elf.so.hints")}, dirs...)...).Run(); err != nil {
 		return
 	}
@@ -430,6 +526,26 @@ func (pa PkgAsset) Deploy(core utils.Core, gh *github.Client, r utils.Runner, mn
 	return
 }
 
+func (pa PkgAsset) Resolve(gh *github.Client, info containerInfo) (project.ResolvedAsset, error) {
+	return project.ResolvedAsset{Pkgs: pa.Pkgs}, nil
+}
+
+func (pa PkgAsset) MarshalYAML() (any, error) {
+	return map[string][]string{"pkg": pa.Pkgs}, nil
+}
+
+func (pa PkgAsset) Validate(v *project.Validator, at project.Path) {
+	if len(pa.Pkgs) == 0 {
+		v.Errorf(at.Key("pkg"), "no packages specified")
+	}
+
+	for i, pkg := range pa.Pkgs {
+		if strings.TrimSpace(pkg) == "" {
+			v.Errorf(at.Key("pkg").Index(i), "empty package name")
+		}
+	}
+}
+
 func (pa PkgAsset) pkg(r utils.Runner, abi, osv, root, command string, args ...string) *utils.Cmd {
 	return r.Command("pkg", append([]string{"--rootdir", root, command}, args...)...).
 		WithEnv("ABI="+abi, "ASSUME_ALWAYS_YES=yes", "OSVERSION="+osv, "PKG_CACHEDIR=/tmp/pkg")
@@ -474,6 +590,84 @@ func (ra ReleaseAsset) Deploy(core utils.Core, gh *github.Client, r utils.Runner
 	return
 }
 
+func (ra ReleaseAsset) Resolve(gh *github.Client, info containerInfo) (res project.ResolvedAsset, err error) {
+	var rls *github.RepositoryRelease
+
+	if rls, info.Version, err = ra.Release.ReleaseVersion(gh); err != nil {
+		return
+	}
+
+	res.Version, res.Ref = info.Version, rls.GetTagName()
+	glob := info.Apply(ra.Glob)
+
+	for _, a := range rls.Assets {
+		if ok, _ := path.Match(glob, a.GetName()); ok {
+			res.URL = a.GetBrowserDownloadURL()
+			return
+		}
+	}
+
+	err = fmt.Errorf("could not find matching asset from release in %q: %q", ra.Release.Repo, glob)
+	return
+}
+
+func (ra ReleaseAsset) Validate(v *project.Validator, at project.Path) {
+	if ra.Glob == "" {
+		v.Errorf(at, "no glob specified for release %q", ra.Release.Repo)
+	} else {
+		v.Placeholders(at.Key("glob"), ra.Glob, assetPlaceholders...)
+
+		if _, err := path.Match(ra.Glob, ""); err != nil {
+			v.Errorf(at.Key("glob"), "invalid glob %q: %v", ra.Glob, err)
+		}
+	}
+
+	validateFiles(v, at.Key("files"), ra.Files)
+}
+
+func (ua URLAsset) validate(v *project.Validator, at project.Path) {
+	u, err := url.Parse(ua.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		v.Errorf(at, "invalid url: %q", ua.URL)
+	}
+
+	v.Placeholders(at, ua.URL, assetPlaceholders...)
+}
+
+func validateFiles(v *project.Validator, at project.Path, files []ArchiveFile) {
+	for i, af := range files {
+		p := at.Index(i)
+
+		if af.Src == "" {
+			v.Errorf(p, "missing src")
+		} else {
+			v.Placeholders(p.Key("src"), af.Src, assetPlaceholders...)
+
+			if !doublestar.ValidatePattern(strings.TrimSuffix(af.Src, "/")) {
+				v.Errorf(p.Key("src"), "invalid pattern: %q", af.Src)
+			}
+		}
+
+		if af.Dst != "" {
+			v.Placeholders(p.Key("dst"), af.Dst, assetPlaceholders...)
+
+			if !strings.HasPrefix(af.Dst, "/") {
+				v.Errorf(p.Key("dst"), "destination is not absolute: %q", af.Dst)
+			}
+		}
+	}
+}
+
+func (ci *containerInfo) setArch(arch string) error {
+	a, err := project.LookupArch(arch)
+	if err != nil {
+		return err
+	}
+
+	ci.Arch, ci.Triple = a.Name, a.Triple
+	return nil
+}
+
 func (ci containerInfo) Apply(s string) string {
 	return strings.NewReplacer(
 		"{project}", ci.Project,
@@ -528,6 +722,36 @@ func (ca *Asset) UnmarshalYAML(b []byte) error {
 	return fmt.Errorf("could not determine asset type")
 }
 
+func (ca Asset) MarshalYAML() (any, error) {
+	return ca.Deployable, nil
+}
+
+func (ca *Asset) JSONSchema(g *schema.Generator) *schema.Schema {
+	pkg := &schema.Schema{
+		Type:                 "object",
+		Properties:           map[string]*schema.Schema{"pkg": g.Reflect(StringOrStringSlice{})},
+		Required:             []string{"pkg"},
+		AdditionalProperties: false,
+	}
+
+	release := g.Struct(ReleaseAsset{})
+	release.Required = []string{"release"}
+
+	return schema.OneOf(pkg, g.Reflect(ArchiveAsset{}), g.Reflect(FileAsset{}), release)
+}
+
+func (aa *ArchiveAsset) JSONSchema(g *schema.Generator) *schema.Schema {
+	s := g.Struct(rawArchiveAsset{})
+	s.Required = []string{"archive"}
+	return s
+}
+
+func (fa *FileAsset) JSONSchema(g *schema.Generator) *schema.Schema {
+	s := g.Struct(rawFileAsset{})
+	s.Required = []string{"file"}
+	return s
+}
+
 func (ai *assetInfo) AddAnnotation(name, value string) {
 	if ai.Annotations == nil {
 		ai.Annotations = make(map[string]string)
@@ -548,6 +772,8 @@ func calculateDst(src, dst string) string {
 	return dst
 }
 
+var assetPlaceholders = []string{"project", "version", "package", "arch", "triple"}
+
 func try[T any, D interface {
 	*T
 	Deployable
@@ -7,10 +7,13 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/bobg/go-generics/v4/slices"
 	"github.com/cynix/freebsd-binaries/build/project"
+	"github.com/cynix/freebsd-binaries/build/schema"
 	"github.com/cynix/freebsd-binaries/build/utils"
+	"github.com/cynix/freebsd-binaries/build/version"
 	"github.com/goccy/go-yaml"
 	"github.com/google/go-github/v74/github"
 )
@@ -32,11 +35,12 @@ type ContainerConfig struct {
 
 type StringOrStringSlice []string
 
-func (cp *ContainerProject) Hydrate(name string) {
-	cp.Name = name
+func (cp *ContainerProject) Hydrate(name string, s project.Settings) {
+	cp.Name, cp.Settings = name, s
+	cp.Resources.Hydrate()
 
 	if len(cp.Arch) == 0 {
-		cp.Arch = []string{"amd64", "arm64"}
+		cp.Arch = slices.Clone(project.DefaultArchs)
 	}
 
 	for i := range cp.Container.Assets {
@@ -81,12 +85,118 @@ func (cp *ContainerProject) Job(gh *github.Client) (project.ProjectJob, error) {
 	}, nil
 }
 
-func (cp *ContainerProject) BuildPackage(core utils.Core, gh *github.Client, version, name string) error {
+func (cp *ContainerProject) BuildPackage(core utils.Core, gh *github.Client, r utils.Runner, version, name string) error {
 	return fmt.Errorf("no such package to build: %q", name)
 }
 
-func (cp *ContainerProject) BuildContainer(core utils.Core, gh *github.Client, version, name string) error {
-	return cp.Container.Build(core, gh, containerInfo{Project: cp.Name, Version: version, Package: name}, cp.Arch)
+func (cp *ContainerProject) BuildContainer(core utils.Core, gh *github.Client, r utils.Runner, version, name string) error {
+	ci := containerInfo{Project: cp.Name, Version: version, Package: name, Deprecated: cp.deprecation(), settings: cp.Settings}
+
+	var err error
+	if ci.Base, err = cp.Container.baseDigest(cp.Settings); err != nil {
+		core.Warning("Could not resolve base image: %v", err)
+	} else if ci.Inputs, err = cp.inputDigest(gh, version, name, ci.Base); err != nil {
+		core.Warning("Could not compute input digest: %v", err)
+	}
+
+	return cp.Container.Build(core, gh, r, ci, cp.Arch)
+}
+
+func (cp *ContainerProject) Fingerprint() (string, error) {
+	return "", nil
+}
+
+func (cp *ContainerProject) Containers() []string {
+	return []string{cp.Name}
+}
+
+func (cp *ContainerProject) Requires() []project.Requirement {
+	return cp.Container.Requires(cp.Settings, cp.Name, cp.Name)
+}
+
+func (cp *ContainerProject) Sources() (refs []version.RepoRef) {
+	for _, a := range cp.Container.Assets {
+		if x, ok := a.Deployable.(*ReleaseAsset); ok {
+			refs = append(refs, x.Release.RepoRef)
+		}
+	}
+
+	return
+}
+
+// Upstream returns the version of the first asset that has one. Versions of
+// FreeBSD packages are not known without a base image.
+func (cp *ContainerProject) Upstream(gh *github.Client) (up project.Upstream, err error) {
+	for _, a := range cp.Container.Assets {
+		switch x := a.Deployable.(type) {
+		case *ReleaseAsset:
+			var ref string
+			if ref, up.Version, err = x.Release.RefVersion(gh); err != nil {
+				return
+			}
+
+			up.Date, err = x.Release.RefDate(gh, ref)
+			return
+
+		case *ArchiveAsset:
+			if !x.Version.IsZero() {
+				up.Version, err = x.Version.Resolve()
+				return
+			}
+
+		case *FileAsset:
+			if !x.Version.IsZero() {
+				up.Version, err = x.Version.Resolve()
+				return
+			}
+		}
+	}
+
+	return
+}
+
+func (cp *ContainerProject) Resolve(gh *github.Client) (res project.Resolution, err error) {
+	res.Assets, err = cp.ResolveAssets(gh, "", cp.Name)
+	return
+}
+
+// ResolveAssets returns the assets that would be deployed by BuildContainer
+// for each arch.
+func (cp *ContainerProject) ResolveAssets(gh *github.Client, version, name string) (assets []project.ResolvedAsset, err error) {
+	ci := containerInfo{Project: cp.Name, Version: version, Package: name}
+
+	for _, arch := range cp.Arch {
+		if err = ci.setArch(arch); err != nil {
+			return
+		}
+
+		for _, a := range cp.Container.Assets {
+			var ra project.ResolvedAsset
+			if ra, err = a.Resolve(gh, ci); err != nil {
+				return
+			}
+
+			ra.Container, ra.Arch = name, arch
+			assets = append(assets, ra)
+		}
+	}
+
+	return
+}
+
+func (cp *ContainerProject) Validate(v *project.Validator, at project.Path) {
+	cp.BaseProject.Validate(v, at)
+	v.Root(cp.Name)
+
+	if len(cp.Container.Assets) == 0 {
+		v.Errorf(at.Key("container"), "no assets defined")
+	}
+
+	cp.Container.Validate(v, at.Key("container"))
+}
+
+func (cp *ContainerProject) JSONSchema(g *schema.Generator) *schema.Schema {
+	return project.RequireSchema(project.BaseSchema(g.Struct(cp)), "container")
 }
 
 func (conf *ContainerConfig) Hydrate(defaults ContainerConfig) {
@@ -99,7 +209,7 @@ func (conf *ContainerConfig) Hydrate(defaults ContainerConfig) {
 	}
 
 	if len(conf.Env) == 0 {
-		maps.Copy(conf.Env, defaults.Env)
+		conf.Env = maps.Clone(defaults.Env)
 	}
 
 	if conf.User == "" {
@@ -115,7 +225,42 @@ func (conf *ContainerConfig) Hydrate(defaults ContainerConfig) {
 	}
 }
 
-func (conf ContainerConfig) Build(core utils.Core, gh *github.Client, ci containerInfo, archs []string) error {
+// Requires lists the releases and the base image that the container of
+// package name in project prj is built from.
+func (conf ContainerConfig) Requires(s project.Settings, prj, name string) (reqs []project.Requirement) {
+	ci := containerInfo{Project: prj, Package: name, settings: s}
+
+	for _, a := range conf.Assets {
+		switch x := a.Deployable.(type) {
+		case *ReleaseAsset:
+			reqs = append(reqs, project.Requirement{Repo: x.Release.Repo, Tag: x.Release.Ref, Regex: x.Release.Regex()})
+
+		case *ArchiveAsset:
+			reqs = append(reqs, x.URLAsset.requires(ci)...)
+
+		case *FileAsset:
+			reqs = append(reqs, x.URLAsset.requires(ci)...)
+		}
+	}
+
+	return append(reqs, project.Requirement{Image: conf.base(s)})
+}
+
+func (conf ContainerConfig) Validate(v *project.Validator, at project.Path) {
+	for i, a := range conf.Assets {
+		a.Validate(v, at.Key("assets").Index(i))
+	}
+
+	for k := range conf.Env {
+		if k == "" || strings.ContainsAny(k, "= ") {
+			v.Errorf(at.Key("env"), "invalid env name: %q", k)
+		}
+	}
+
+	v.User(at.Key("user"), conf.User)
+}
+
+func (conf ContainerConfig) Build(core utils.Core, gh *github.Client, r utils.Runner, ci containerInfo, archs []string) error {
 	if len(archs) == 0 {
 		return fmt.Errorf("no arch defined")
 	}
@@ -124,11 +269,15 @@ func (conf ContainerConfig) Build(core utils.Core, gh *github.Client, ci contain
 		return fmt.Errorf("no assets defined")
 	}
 
-	fc, err := utils.NewFirecracker("build/build.freebsd_amd64", "172.16.0.2:22", "root", "/etc/ssh/freebsd.id_rsa")
-	if err != nil {
-		return fmt.Errorf("could not connect to FreeBSD VM: %w", err)
+	if r == nil {
+		fc, err := utils.NewFirecracker("build/build.freebsd_amd64", "172.16.0.2:22", "root", "/etc/ssh/freebsd.id_rsa")
+		if err != nil {
+			return fmt.Errorf("could not connect to FreeBSD VM: %w", err)
+		}
+		defer fc.Close()
+
+		r = fc
 	}
-	defer fc.Close()
 
 	setup, err := os.Open("build/setup-freebsd.sh")
 	if err != nil {
@@ -136,43 +285,44 @@ func (conf ContainerConfig) Build(core utils.Core, gh *github.Client, ci contain
 	}
 	defer setup.Close()
 
-	if err := core.Group("Setting up FreeBSD", func() error { return fc.Command("sh", "-e").WithInput(setup).Run() }); err != nil {
+	if err := core.Group("Setting up FreeBSD", func() error { return r.Command("sh", "-e").WithInput(setup).Run() }); err != nil {
 		return fmt.Errorf("could not run setup-freebsd.sh: %w", err)
 	}
 
-	base := conf.base()
-	if err := core.Group(fmt.Sprintf("Pulling %s", base), func() error { return fc.Command("podman", "pull", base).Run() }); err != nil {
+	base := conf.base(ci.settings)
+	if err := core.Group(fmt.Sprintf("Pulling %s", base), func() error { return r.Command("podman", "pull", base).Run() }); err != nil {
 		return fmt.Errorf("could not pull %q: %w", base, err)
 	}
 
-	if ci.FreeBSD, err = fc.Command("podman", "image", "inspect", "--format={{index .Annotations \"org.freebsd.version\"}}", base).First(); err != nil {
+	if ci.FreeBSD, err = r.Command("podman", "image", "inspect", "--format={{index .Annotations \"org.freebsd.version\"}}", base).First(); err != nil {
 		return fmt.Errorf("could not inspect %q: %w", base, err)
 	}
 
-	latest := fmt.Sprintf("ghcr.io/cynix/%s:latest", ci.Package)
+	latest := ci.settings.Image(ci.Package, "latest")
 	var tagged string
 
 	if ci.Version != "" {
-		tagged = fmt.Sprintf("ghcr.io/cynix/%s:%s", ci.Package, ci.Version)
+		tagged = ci.settings.Image(ci.Package, ci.Version)
 	}
 
 	for _, ci.Arch = range archs {
-		if tagged, err = conf.build(core, gh, fc, "/mnt/firecracker", ci, latest, tagged, base); err != nil {
+		if tagged, err = conf.build(core, gh, r, "/mnt/firecracker", ci, latest, tagged, base); err != nil {
 			return err
 		}
 	}
 
 	return core.Group("Pushing images", func() error {
-		if err := fc.Command("buildah", "login", "--username="+os.Getenv("GITHUB_ACTOR"), "--password="+os.Getenv("GITHUB_TOKEN"), "ghcr.io").Run(); err != nil {
-			return fmt.Errorf("could not login to ghcr.io: %w", err)
+		host := ci.settings.RegistryHost()
+		if err := r.Command("buildah", "login", "--username="+os.Getenv("GITHUB_ACTOR"), "--password="+os.Getenv("GITHUB_TOKEN"), host).Run(); err != nil {
+			return fmt.Errorf("could not login to %s: %w", host, err)
 		}
 
-		if err := fc.Command("buildah", "manifest", "push", "--all", latest, "docker://"+latest).Run(); err != nil {
+		if err := r.Command("buildah", "manifest", "push", "--all", latest, "docker://"+latest).Run(); err != nil {
 			return fmt.Errorf("could not push %q: %w", latest, err)
 		}
 
 		if tagged != "" {
-			if err := fc.Command("buildah", "manifest", "push", "--all", latest, "docker://"+tagged).Run(); err != nil {
+			if err := r.Command("buildah", "manifest", "push", "--all", latest, "docker://"+tagged).Run(); err != nil {
 				return fmt.Errorf("could not push %q: %w", tagged, err)
 			}
 		}
@@ -181,33 +331,28 @@ func (conf ContainerConfig) Build(core utils.Core, gh *github.Client, ci contain
 	})
 }
 
-func (conf ContainerConfig) base() string {
+func (conf ContainerConfig) base(s project.Settings) string {
 	if conf.Base != "" {
-		return "ghcr.io/cynix/" + conf.Base
+		return s.BaseImage(conf.Base)
 	}
 
 	for _, a := range conf.Assets {
 		if _, ok := a.Deployable.(PkgAsset); ok {
-			return "ghcr.io/cynix/freebsd:runtime"
+			return s.BaseImage("freebsd:runtime")
 		}
 	}
 
-	return "ghcr.io/cynix/freebsd:static"
+	return s.BaseImage("freebsd:static")
 }
 
-func (conf ContainerConfig) build(core utils.Core, gh *github.Client, fc *utils.Firecracker, mnt string, ci containerInfo, latest, tagged, base string) (string, error) {
+func (conf ContainerConfig) build(core utils.Core, gh *github.Client, r utils.Runner, mnt string, ci containerInfo, latest, tagged, base string) (string, error) {
 	core.Info("Building arch: %s", ci.Arch)
 
-	switch ci.Arch {
-	case "amd64":
-		ci.Triple = "x86_64-unknown-freebsd"
-	case "arm64":
-		ci.Triple = "aarch64-unknown-freebsd"
-	default:
-		return tagged, fmt.Errorf("unsupported arch: %q", ci.Arch)
+	if err := ci.setArch(ci.Arch); err != nil {
+		return tagged, err
 	}
 
-	c := &container{l: core, fc: fc, manifest: latest}
+	c := &container{l: core, r: r, manifest: latest}
 	if err := c.Create(base, ci.Arch); err != nil {
 		return tagged, fmt.Errorf("could not create %s container: %w", ci.Arch, err)
 	}
@@ -216,7 +361,9 @@ func (conf ContainerConfig) build(core utils.Core, gh *github.Client, fc *utils.
 	if fi, err := os.Stat(path.Join(ci.Package, "root")); err == nil && fi.IsDir() {
 		c.l.Info("Copying %s/root", ci.Package)
 
-		if err = utils.CopyDir(path.Join(mnt, c.root), path.Join(ci.Package, "root")); err != nil {
+		if err = utils.Perform(r, utils.Step{Action: "copy", Target: path.Join(ci.Package, "root") + " -> " + c.root}, func() error {
+			return utils.CopyDir(path.Join(mnt, c.root), path.Join(ci.Package, "root"))
+		}); err != nil {
 			return tagged, fmt.Errorf("could not copy %s/root: %w", ci.Package, err)
 		}
 	} else if !errors.Is(err, os.ErrNotExist) {
@@ -225,10 +372,10 @@ func (conf ContainerConfig) build(core utils.Core, gh *github.Client, fc *utils.
 
 	if user, uid, _ := strings.Cut(conf.User, "="); uid != "" {
 		if err := c.l.Group(fmt.Sprintf("Creating user %q = %s", user, uid), func() error {
-			if err := fc.Command("pw", "-R", c.root, "groupadd", "-n", user, "-g", uid).Run(); err != nil {
+			if err := r.Command("pw", "-R", c.root, "groupadd", "-n", user, "-g", uid).Run(); err != nil {
 				return fmt.Errorf("could not create group %q: %w", user, err)
 			}
-			if err := fc.Command("pw", "-R", c.root, "useradd", "-n", user, "-u", uid, "-g", user, "-d", "/nonexistent", "-s", "/sbin/nologin").Run(); err != nil {
+			if err := r.Command("pw", "-R", c.root, "useradd", "-n", user, "-u", uid, "-g", user, "-d", "/nonexistent", "-s", "/sbin/nologin").Run(); err != nil {
 				return fmt.Errorf("could not create user %q: %w", user, err)
 			}
 			return nil
@@ -240,7 +387,7 @@ func (conf ContainerConfig) build(core utils.Core, gh *github.Client, fc *utils.
 	var args []string
 
 	for _, a := range conf.Assets {
-		ai, err := a.Deploy(core, gh, fc, mnt, c.root, ci)
+		ai, err := a.Deploy(core, gh, r, mnt, c.root, ci)
 		if err != nil {
 			return tagged, err
 		}
@@ -252,7 +399,9 @@ func (conf ContainerConfig) build(core utils.Core, gh *github.Client, fc *utils.
 			conf.Entrypoint = []string{ai.InferredEntrypoint}
 
 			if _, ok := a.Deployable.(FileAsset); ok {
-				if err := os.Chmod(path.Join(mnt, c.root, ai.InferredEntrypoint), 0o755); err != nil {
+				if err := utils.Perform(r, utils.Step{Action: "chmod", Target: "0755 " + path.Join(c.root, ai.InferredEntrypoint)}, func() error {
+					return os.Chmod(path.Join(mnt, c.root, ai.InferredEntrypoint), 0o755)
+				}); err != nil {
 					return tagged, fmt.Errorf("could not chmod entrypoint %q: %w", ai.InferredEntrypoint, err)
 				}
 			}
@@ -260,7 +409,7 @@ func (conf ContainerConfig) build(core utils.Core, gh *github.Client, fc *utils.
 
 		if tagged == "" && ai.InferredVersion != "" {
 			c.l.Info("Deduced image version: %q", ai.InferredVersion)
-			tagged = fmt.Sprintf("ghcr.io/cynix/%s:%s", ci.Package, ai.InferredVersion)
+			tagged = ci.settings.Image(ci.Package, ai.InferredVersion)
 		}
 
 		for k, v := range ai.Annotations {
@@ -268,18 +417,38 @@ func (conf ContainerConfig) build(core utils.Core, gh *github.Client, fc *utils.
 		}
 	}
 
-	if err := os.Chmod(path.Join(mnt, c.root, "/usr/local/sbin"), 0o711); err != nil && !errors.Is(err, os.ErrNotExist) {
+	if err := utils.Perform(r, utils.Step{Action: "chmod", Target: "0711 " + path.Join(c.root, "/usr/local/sbin")}, func() error {
+		return os.Chmod(path.Join(mnt, c.root, "/usr/local/sbin"), 0o711)
+	}); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return tagged, fmt.Errorf("could not chmod /usr/local/sbin: %w", err)
 	}
 
 	if conf.Script != "" {
 		if err := c.l.Group("Running build script", func() error {
-			return fc.Command("sh", "-ex").In(c.root).WithInput(conf.Script).Run()
+			return r.Command("sh", "-ex").In(c.root).WithInput(conf.Script).Run()
 		}); err != nil {
 			return tagged, fmt.Errorf("could not run build script: %w", err)
 		}
 	}
 
+	if ci.Inputs != "" {
+		args = append(args, fmt.Sprintf("--annotation=%s=%s", InputsAnnotation, ci.Inputs))
+	}
+
+	if ci.Base != "" {
+		args = append(args, fmt.Sprintf("--annotation=%s=%s", BaseAnnotation, ci.Base))
+	}
+
+	if ci.FreeBSD != "" {
+		args = append(args, fmt.Sprintf("--annotation=%s=%s", FreeBSDAnnotation, ci.FreeBSD))
+	}
+
+	if ci.Deprecated != "" {
+		args = append(args, fmt.Sprintf("--annotation=%s=%s", DeprecatedAnnotation, ci.Deprecated))
+	}
+
+	args = append(args, fmt.Sprintf("--annotation=%s=%s", CreatedAnnotation, time.Now().UTC().Format(time.RFC3339)))
+
 	entrypoint := strings.Join(slices.Map(conf.Entrypoint, func(s string) string {
 		return fmt.Sprintf("%q", s)
 	}), ",")
@@ -334,17 +503,26 @@ func (ss *StringOrStringSlice) UnmarshalYAML(b []byte) error {
 	return fmt.Errorf("expected a string or string slice")
 }
 
+func (ss *StringOrStringSlice) JSONSchema(g *schema.Generator) *schema.Schema {
+	return schema.OneOf(schema.String(), schema.Array(schema.String()))
+}
+
 type container struct {
 	l        utils.Core
-	fc       *utils.Firecracker
+	r        utils.Runner
 	manifest string
 	id       string
 	root     string
 }
 
 func (c *container) Create(base, arch string) error {
+	a, err := project.LookupArch(arch)
+	if err != nil {
+		return err
+	}
+
 	return c.l.Group(fmt.Sprintf("Creating %s image from %s", arch, base), func() (err error) {
-		if c.id, err = c.fc.Command("buildah", "from", "--arch="+arch, base).First(); err != nil {
+		if c.id, err = c.r.Command("buildah", "from", "--platform="+a.Platform, base).First(); err != nil {
 			return
 		}
 
@@ -382,5 +560,5 @@ func (c *container) Commit() (err error) {
 }
 
 func (c *container) Buildah(command string, args ...string) *utils.Cmd {
-	return utils.Command("buildah", slices.Concat([]string{command}, args, []string{c.id})...).Via(c.fc)
+	return utils.Command("buildah", slices.Concat([]string{command}, args, []string{c.id})...).Via(c.r)
 }
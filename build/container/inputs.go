@@ -0,0 +1,157 @@
+package container
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cynix/freebsd-binaries/build/project"
+	"github.com/cynix/freebsd-binaries/build/registry"
+	"github.com/goccy/go-yaml"
+	"github.com/google/go-github/v74/github"
+)
+
+const (
+	// InputsAnnotation is the image annotation that records the digest
+	// returned by InputDigest.
+	InputsAnnotation = "com.github.cynix.freebsd-binaries.inputs"
+	// BaseAnnotation records the digest of the base image.
+	BaseAnnotation = "com.github.cynix.freebsd-binaries.base"
+	// FreeBSDAnnotation records the FreeBSD version of the base image.
+	FreeBSDAnnotation = "org.freebsd.version"
+	// DeprecatedAnnotation records the note of a deprecated project.
+	DeprecatedAnnotation = "com.github.cynix.freebsd-binaries.deprecated"
+	// CreatedAnnotation records when the image was built.
+	CreatedAnnotation = "org.opencontainers.image.created"
+)
+
+// InputDigest returns a digest of everything that goes into the container
+// built by BuildContainer: the hydrated config, the resolved assets, the base
+// image and the root overlay. A container need not be rebuilt as long as the
+// digest is unchanged.
+func (cp *ContainerProject) InputDigest(gh *github.Client, version, name string) (string, error) {
+	base, err := cp.Container.baseDigest(cp.Settings)
+	if err != nil {
+		return "", err
+	}
+
+	return cp.inputDigest(gh, version, name, base)
+}
+
+func (cp *ContainerProject) inputDigest(gh *github.Client, version, name, base string) (string, error) {
+	inputs := struct {
+		Arch    []string
+		Version string
+		Config  ContainerConfig
+		Assets  []project.ResolvedAsset
+		Base    string
+		// Deprecating a project rebuilds its images to record the note.
+		Deprecated string `yaml:",omitempty"`
+	}{Arch: cp.Arch, Version: version, Config: cp.Container, Base: base, Deprecated: cp.deprecation()}
+
+	var err error
+	if inputs.Assets, err = cp.ResolveAssets(gh, version, name); err != nil {
+		return "", err
+	}
+
+	b, err := yaml.Marshal(inputs)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write(b)
+
+	if err := hashDir(h, path.Join(name, "root")); err != nil {
+		return "", fmt.Errorf("could not hash %s/root: %w", name, err)
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// deprecation returns the note recorded in the images of a deprecated
+// project.
+func (cp *ContainerProject) deprecation() string {
+	if cp.State != project.StateDeprecated {
+		return ""
+	}
+
+	return cmp.Or(cp.Note, "deprecated")
+}
+
+// baseDigest returns the current digest of the base image.
+func (conf ContainerConfig) baseDigest(s project.Settings) (string, error) {
+	base := conf.base(s)
+	reg, repo, tag := baseRegistry(base)
+
+	digest, err := reg.Digest(repo, tag)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve base image %q: %w", base, err)
+	}
+
+	return digest, nil
+}
+
+// baseRegistry returns the registry, repo and tag of a base image.
+func baseRegistry(base string) (*registry.Client, string, string) {
+	host, ref, _ := strings.Cut(base, "/")
+	repo, tag, _ := strings.Cut(ref, ":")
+
+	return registry.New(host), repo, tag
+}
+
+// hashDir writes the names, modes and contents of the files in dir to h. A
+// missing dir is the same as an empty one.
+func hashDir(h hash.Hash, dir string) error {
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(dir, name)
+		fmt.Fprintf(h, "%s\x00%v\x00", filepath.ToSlash(rel), fi.Mode())
+
+		switch {
+		case fi.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(name)
+			if err != nil {
+				return err
+			}
+			io.WriteString(h, target)
+
+		case fi.Mode().IsRegular():
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+		}
+
+		h.Write([]byte{0})
+		return nil
+	})
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,213 @@
+package container
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cynix/freebsd-binaries/build/project"
+	"github.com/cynix/freebsd-binaries/build/registry"
+	"github.com/google/go-github/v74/github"
+	"github.com/mholt/archives"
+)
+
+// pkgRepo is the FreeBSD package repository that PkgAsset installs from, as
+// configured by setup-freebsd.sh.
+const pkgRepo = "https://pkg.freebsd.org/%s/latest"
+
+// HTTPClient fetches package catalogs.
+var HTTPClient = http.DefaultClient
+
+// RebuildReason returns why the container must be rebuilt, or "" if its
+// published image is up to date: the image is missing, its inputs have
+// changed, its base image has been updated, or the FreeBSD packages installed
+// in it are no longer the latest in the package repository. Updates of the
+// base image and packages are only picked up as often as the schedule of the
+// project allows.
+func (cp *ContainerProject) RebuildReason(gh *github.Client, reg *registry.Client, version, name string) string {
+	published, err := reg.Annotations(cp.Settings.Repository(name), "latest")
+	if err != nil {
+		return fmt.Sprintf("could not inspect published image: %v", err)
+	}
+
+	base := cp.Container.base(cp.Settings)
+	digest, err := cp.Container.baseDigest(cp.Settings)
+	if err != nil {
+		return err.Error()
+	}
+
+	// Images built before creation was recorded are long due.
+	created, _ := time.Parse(time.RFC3339, published[CreatedAnnotation])
+	refresh := cp.RefreshDue(created)
+
+	if prev := published[BaseAnnotation]; prev != "" && prev != digest {
+		if refresh {
+			return fmt.Sprintf("base image %s was updated", base)
+		}
+
+		// Look past the update, as if the image was built from it.
+		digest = prev
+	}
+
+	inputs, err := cp.inputDigest(gh, version, name, digest)
+	if err != nil {
+		return fmt.Sprintf("could not compute input digest: %v", err)
+	}
+
+	if published[InputsAnnotation] != inputs {
+		return "inputs changed"
+	}
+
+	if !refresh {
+		return ""
+	}
+
+	breg, repo, tag := baseRegistry(base)
+
+	annotations, err := breg.Annotations(repo, tag)
+	if err != nil {
+		return fmt.Sprintf("could not inspect base image %s: %v", base, err)
+	}
+
+	freebsd := annotations[FreeBSDAnnotation]
+	if prev := published[FreeBSDAnnotation]; prev != "" && prev != freebsd {
+		return fmt.Sprintf("base image %s was updated from FreeBSD %s to %s", base, prev, freebsd)
+	}
+
+	if !slices.ContainsFunc(cp.Container.Assets, func(a Asset) bool { _, ok := a.Deployable.(PkgAsset); return ok }) {
+		return ""
+	}
+
+	// Annotations are those of the first image, which is built for the
+	// first arch.
+	abi, err := project.PkgABI(freebsd, cp.Arch[0])
+	if err != nil {
+		return err.Error()
+	}
+
+	catalog, err := pkgCatalog(abi)
+	if err != nil {
+		return fmt.Sprintf("could not fetch %s package catalog: %v", abi, err)
+	}
+
+	var updates []string
+
+	for _, k := range slices.Sorted(maps.Keys(published)) {
+		pkg, ok := strings.CutPrefix(k, "org.freebsd.pkg.")
+		if pkg, ok = strings.CutSuffix(pkg, ".version"); !ok {
+			continue
+		}
+
+		if cur, ok := catalog[pkg]; ok && cur != published[k] {
+			updates = append(updates, fmt.Sprintf("%s %s -> %s", pkg, published[k], cur))
+		}
+	}
+
+	if len(updates) > 0 {
+		return "packages were updated: " + strings.Join(updates, ", ")
+	}
+
+	return ""
+}
+
+// catalogs holds the package versions of each ABI, which are fetched once.
+var catalogs struct {
+	sync.Mutex
+	m map[string]func() (map[string]string, error)
+}
+
+// pkgCatalog returns the version of every package in the repository of abi.
+func pkgCatalog(abi string) (map[string]string, error) {
+	catalogs.Lock()
+
+	if catalogs.m == nil {
+		catalogs.m = make(map[string]func() (map[string]string, error))
+	}
+
+	get, ok := catalogs.m[abi]
+	if !ok {
+		get = sync.OnceValues(func() (map[string]string, error) { return fetchCatalog(abi) })
+		catalogs.m[abi] = get
+	}
+
+	catalogs.Unlock()
+
+	return get()
+}
+
+func fetchCatalog(abi string) (map[string]string, error) {
+	u := fmt.Sprintf(pkgRepo, abi) + "/packagesite.pkg"
+
+	resp, err := HTTPClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("could not download %q: %v", u, resp.Status)
+	}
+
+	format, stream, err := archives.Identify(context.TODO(), path.Base(u), resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	ex, ok := format.(archives.Extractor)
+	if !ok {
+		return nil, fmt.Errorf("unsupported catalog format: %q", u)
+	}
+
+	catalog := make(map[string]string)
+
+	err = ex.Extract(context.TODO(), stream, func(ctx context.Context, f archives.FileInfo) error {
+		if f.NameInArchive != "packagesite.yaml" {
+			return nil
+		}
+
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		// Each line is the JSON manifest of one package.
+		sc := bufio.NewScanner(r)
+		sc.Buffer(nil, 16<<20)
+
+		for sc.Scan() {
+			var m struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			}
+
+			if err := json.Unmarshal(sc.Bytes(), &m); err == nil && m.Name != "" {
+				catalog[m.Name] = m.Version
+			}
+		}
+
+		if err := sc.Err(); err != nil {
+			return err
+		}
+
+		return fs.SkipAll
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(catalog) == 0 {
+		return nil, fmt.Errorf("no packages in %q", u)
+	}
+
+	return catalog, nil
+}
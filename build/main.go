@@ -1,102 +1,309 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
-	"github.com/actions-go/toolkit/github"
 	"github.com/cynix/freebsd-binaries/build/config"
+	"github.com/cynix/freebsd-binaries/build/container"
+	"github.com/cynix/freebsd-binaries/build/project"
+	"github.com/cynix/freebsd-binaries/build/registry"
+	"github.com/cynix/freebsd-binaries/build/schema"
 	"github.com/cynix/freebsd-binaries/build/utils"
-	"github.com/goccy/go-yaml"
+	"github.com/cynix/freebsd-binaries/build/version"
+	"github.com/google/go-github/v74/github"
 	"github.com/sanity-io/litter"
 )
 
 func main() {
-	os.Exit(run(utils.GitHubCore{}))
-}
-
-func run(core utils.Core) int {
 	if len(os.Args) < 2 {
-		core.Fail("Missing subcommand")
-		return 1
+		fmt.Fprintln(os.Stderr, "Missing subcommand")
+		os.Exit(1)
 	}
 
 	if os.Args[1] == "serve" {
 		if len(os.Args) < 3 {
 			fmt.Println("Missing command marker")
-			return 1
+			os.Exit(1)
 		}
 
 		if err := utils.ServeFirecracker(os.Args[2], os.Stdin, os.Stdout); err != nil {
 			fmt.Printf("Could not serve: %v\n", err)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	fs := flag.NewFlagSet(os.Args[1], flag.ContinueOnError)
+	verbose := fs.Bool("verbose", false, "Show debug output")
+	conf := fs.String("config", "projects.yaml", "Config file, or directory of config files")
+	cacheDir := fs.String("cache", defaultCacheDir(), "Directory to cache HTTP responses in, or empty to disable caching")
+	cacheTTL := fs.Duration("cache-ttl", 5*time.Minute, "How long cached responses are used before they are revalidated")
+	offline := fs.Bool("offline", false, "Serve HTTP responses only from the cache")
+
+	for _, in := range inputs[os.Args[1]] {
+		if in.boolean {
+			fs.Bool(in.name, false, in.usage)
+		} else {
+			fs.String(in.name, in.value, in.usage)
+		}
+	}
+
+	if err := fs.Parse(os.Args[2:]); err != nil {
+		os.Exit(2)
+	}
+
+	var core utils.Core = utils.GitHubCore{}
+
+	if os.Getenv("GITHUB_ACTIONS") != "true" {
+		tc := utils.NewTerminalCore(fs)
+		tc.Verbose = *verbose
+		core = tc
+	}
+
+	transport := http.DefaultTransport
+
+	if *offline && *cacheDir == "" {
+		core.Fail("Cannot go offline without a cache")
+		os.Exit(2)
+	}
+
+	if *cacheDir != "" {
+		transport = &utils.HTTPCache{Dir: *cacheDir, TTL: *cacheTTL, Offline: *offline, Transport: transport}
+		client := &http.Client{Transport: transport}
+		version.HTTPClient, registry.HTTPClient, container.HTTPClient = client, client, client
+	}
+
+	os.Exit(run(core, os.Args[1], *conf, transport, fs.Args()))
+}
+
+// defaultCacheDir returns where HTTP responses are cached by default, which is
+// nowhere under GitHub Actions.
+func defaultCacheDir() string {
+	if os.Getenv("GITHUB_ACTIONS") == "true" {
+		return ""
+	}
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "freebsd-binaries")
+}
+
+type input struct {
+	name    string
+	usage   string
+	value   string
+	boolean bool
+}
+
+// inputs lists the inputs of each subcommand, which are read from INPUT_*
+// under GitHub Actions and from flags otherwise.
+var inputs = map[string][]input{
+	"matrix": {
+		{name: "projects", usage: "Comma-separated project selectors to build, or \"all\""},
+		{name: "force", usage: "Build even if already released or unchanged", boolean: true},
+	},
+	"package": {
+		{name: "project", usage: "Project to build"},
+		{name: "version", usage: "Version to build"},
+		{name: "package", usage: "Package to build"},
+	},
+	"container": {
+		{name: "project", usage: "Project to build"},
+		{name: "version", usage: "Version to build"},
+		{name: "container", usage: "Container to build"},
+	},
+	"dump": {
+		{name: "projects", usage: "Comma-separated project selectors to dump, or all if empty"},
+		{name: "format", usage: "Output format: yaml or json"},
+		{name: "resolve", usage: "Resolve upstream refs, versions and asset URLs", boolean: true},
+	},
+	"outdated": {
+		{name: "projects", usage: "Comma-separated project selectors to check, or all if empty"},
+		{name: "format", usage: "Output format: table, json or prometheus"},
+		{name: "output", usage: "File to write instead of stdout"},
+	},
+	"plan": {
+		{name: "project", usage: "Project to plan"},
+		{name: "version", usage: "Version to plan"},
+		{name: "package", usage: "Package to plan"},
+		{name: "container", usage: "Container to plan"},
+		{name: "format", usage: "Output format: text or json"},
+		{name: "freebsd", usage: "FreeBSD version assumed for the base image", value: "14.3"},
+	},
+	"repo": {
+		{name: "output", usage: "Directory to create the repositories in", value: "repo"},
+		{name: "key", usage: "PEM RSA private key, or file containing it, to sign the repositories with"},
+	},
+}
+
+func run(core utils.Core, cmd, name string, transport http.RoundTripper, args []string) int {
+	if cmd == "schema" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+
+		if err := enc.Encode(schema.Generate(&config.Config{})); err != nil {
+			core.Fail("Failed to write schema: %v", err)
 			return 1
 		}
 
 		return 0
 	}
 
-	f, err := os.Open("projects.yaml")
-	if err != nil {
+	conf, err := config.Load(name)
+	if conf == nil {
 		core.Fail("Failed to read config: %v", err)
 		return 1
 	}
 
-	var conf config.Config
+	if cmd == "validate" {
+		issues := conf.Validate(".")
+
+		for _, issue := range issues {
+			core.Error("%s", issue)
+		}
 
-	if err := yaml.NewDecoder(f, yaml.DisallowUnknownField()).Decode(&conf); err != nil {
+		if len(issues) > 0 {
+			core.Fail("Found %d problems", len(issues))
+			return 1
+		}
+
+		// Every error should have been recorded as an issue, but a config
+		// that cannot be loaded is never valid.
+		if err != nil {
+			core.Fail("Failed to parse config: %v", err)
+			return 1
+		}
+
+		core.Info("No problems found in %d projects", len(conf.Projects))
+		return 0
+	}
+
+	if err != nil {
 		core.Fail("Failed to parse config: %v", err)
 		return 1
 	}
 
-	switch os.Args[1] {
+	gh, err := newGitHub(core, conf.Settings, transport)
+	if err != nil {
+		core.Fail("Failed to create GitHub client: %v", err)
+		return 1
+	}
+
+	switch cmd {
 	case "dump":
-		if len(os.Args) < 3 {
-			litter.Dump(conf)
-			return 0
+		projects := strings.Split(core.GetInput("projects"), ",")
+		if len(args) > 0 {
+			projects = args
 		}
 
-		prj, ok := conf.Projects[os.Args[2]]
-		if !ok {
-			fmt.Println("Invalid project:", prj)
+		var dump map[string]any
+
+		if core.GetBoolInput("resolve") {
+			dump, err = conf.Dump(gh, projects)
+		} else {
+			dump, err = conf.Dump(nil, projects)
+		}
+
+		if err != nil {
+			core.Fail("Failed to dump config: %v", err)
 			return 1
 		}
 
-		litter.Dump(prj)
-		return 0
+		b, err := config.Marshal(dump, core.GetInput("format"))
+		if err != nil {
+			core.Fail("Failed to write config: %v", err)
+			return 1
+		}
+
+		os.Stdout.Write(b)
 
 	case "matrix":
 		projects := core.GetInput("projects")
 		force := core.GetBoolInput("force")
 
-		switch projects {
-		case "":
+		if projects == "" {
 			core.Fail("No projects specified")
 			return 1
-		case "all":
-			projects = ""
 		}
 
-		matrix, err := conf.Matrix(github.GitHub, strings.Split(projects, ","), force)
+		stages, err := conf.Matrix(core, gh, registry.New(conf.Settings.RegistryHost()), strings.Split(projects, ","), force)
 		if err != nil {
 			core.Fail("Failed to generate matrix: %v", err)
 			return 1
 		}
 
-		core.Group("Generated matrix", func() error {
-			litter.Dump(matrix.Include)
-			return nil
-		})
+		// Each stage is a job in dispatch.yaml, which validate checks.
+		if len(stages) > config.MaxStages {
+			core.Fail("Too many stages: %d > %d", len(stages), config.MaxStages)
+			return 1
+		}
+
+		for i, matrix := range stages {
+			core.Group(fmt.Sprintf("Generated matrix for stage %d", i+1), func() error {
+				litter.Dump(matrix.Include)
+				return nil
+			})
 
-		b, err := json.Marshal(matrix)
+			b, err := json.Marshal(matrix)
+			if err != nil {
+				core.Fail("Failed to marshal matrix: %v", err)
+				return 1
+			}
+
+			core.SetOutput(fmt.Sprintf("stage%d", i+1), string(b))
+		}
+
+		return 0
+
+	case "outdated":
+		now := time.Now()
+
+		report, err := conf.Outdated(gh, registry.New(conf.Settings.RegistryHost()), strings.Split(core.GetInput("projects"), ","), now)
 		if err != nil {
-			core.Fail("Failed to marshal matrix: %v", err)
+			core.Fail("Failed to check projects: %v", err)
 			return 1
 		}
 
-		core.SetOutput("matrix", string(b))
-		return 0
+		var buf bytes.Buffer
+
+		switch format := core.GetInput("format"); format {
+		case "", "table":
+			err = report.WriteTable(&buf)
+		case "json":
+			enc := json.NewEncoder(&buf)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(report)
+		case "prometheus":
+			err = report.WritePrometheus(&buf, now)
+		default:
+			core.Fail("Unknown format: %q", format)
+			return 1
+		}
+
+		if err == nil {
+			err = writeOutput(core.GetInput("output"), buf.Bytes())
+		}
+
+		if err != nil {
+			core.Fail("Failed to write report: %v", err)
+			return 1
+		}
 
 	case "package":
 		project := core.GetInput("project")
@@ -114,7 +321,7 @@ func run(core utils.Core) int {
 			return 1
 		}
 
-		if err := prj.BuildPackage(core, github.GitHub, version, name); err != nil {
+		if err := prj.BuildPackage(core, gh, nil, version, name); err != nil {
 			core.Fail("Failed to build %q: %v", name, err)
 			return 1
 		}
@@ -135,15 +342,171 @@ func run(core utils.Core) int {
 			return 1
 		}
 
-		if err := prj.BuildContainer(core, github.GitHub, version, name); err != nil {
+		if err := prj.BuildContainer(core, gh, nil, version, name); err != nil {
 			core.Fail("Failed to build %q: %v", name, err)
 			return 1
 		}
 
+	case "plan":
+		project := core.GetInput("project")
+		version := core.GetInput("version")
+		pkg := core.GetInput("package")
+		ctr := core.GetInput("container")
+
+		if project == "" || (pkg == "") == (ctr == "") || (pkg != "" && version == "") {
+			core.Fail("Missing inputs: project=%q version=%q package=%q container=%q", project, version, pkg, ctr)
+			return 1
+		}
+
+		prj, ok := conf.Projects[project]
+		if !ok {
+			core.Fail("Unknown project: %q", project)
+			return 1
+		}
+
+		freebsd := core.GetInput("freebsd")
+		rec := &utils.Recorder{
+			Redact: []string{os.Getenv("GITHUB_TOKEN")},
+			Output: func(args []string) string {
+				if slices.Contains(args, "inspect") {
+					return freebsd
+				}
+				return fmt.Sprintf("$(%s)", strings.Join(args[:min(2, len(args))], " "))
+			},
+		}
+
+		if pkg != "" {
+			err = prj.BuildPackage(rec.Core(core), gh, rec, version, pkg)
+		} else {
+			err = prj.BuildContainer(rec.Core(core), gh, rec, version, ctr)
+		}
+
+		if err != nil {
+			core.Fail("Failed to plan %q: %v", pkg+ctr, err)
+			return 1
+		}
+
+		switch format := core.GetInput("format"); format {
+		case "", "text":
+			err = rec.WriteText(os.Stdout)
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(rec.Steps)
+		default:
+			core.Fail("Unknown format: %q", format)
+			return 1
+		}
+
+		if err != nil {
+			core.Fail("Failed to write plan: %v", err)
+			return 1
+		}
+
+	case "repo":
+		var key *rsa.PrivateKey
+
+		if k := core.GetInput("key"); k != "" {
+			if key, err = readKey(k); err != nil {
+				core.Fail("Failed to read key: %v", err)
+				return 1
+			}
+		} else {
+			core.Warning("Creating unsigned repositories")
+		}
+
+		if err := conf.Repo(core, gh, &http.Client{Transport: transport}, core.GetInput("output"), key); err != nil {
+			core.Fail("Failed to create repositories: %v", err)
+			return 1
+		}
+
 	default:
-		fmt.Printf("Invalid subcommand: %q", os.Args[1])
+		fmt.Printf("Invalid subcommand: %q", cmd)
 		return 1
 	}
 
 	return 0
 }
+
+// readKey parses an RSA private key in PEM, given either directly or as the
+// name of the file containing it.
+func readKey(s string) (*rsa.PrivateKey, error) {
+	b := []byte(s)
+
+	if !strings.HasPrefix(s, "-----BEGIN") {
+		var err error
+		if b, err = os.ReadFile(s); err != nil {
+			return nil, err
+		}
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA key: %T", key)
+	}
+
+	return rsaKey, nil
+}
+
+// writeOutput writes b to stdout, or atomically replaces the named file so
+// that readers such as the textfile collector never see a partial file.
+func writeOutput(name string, b []byte) error {
+	if name == "" {
+		_, err := os.Stdout.Write(b)
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
+
+func newGitHub(core utils.Core, s project.Settings, transport http.RoundTripper) (*github.Client, error) {
+	gh := github.NewClient(&http.Client{Transport: &utils.RateLimited{Core: core, Transport: transport, Retries: 3, MaxWait: 15 * time.Minute}})
+
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		gh = gh.WithAuthToken(token)
+	}
+
+	// Rate limits are waited out by the transport, which must therefore see
+	// every request.
+	gh.DisableRateLimitCheck = true
+
+	if s.GitHub.API != gh.BaseURL.String() {
+		return gh.WithEnterpriseURLs(s.GitHub.API, s.GitHub.Server)
+	}
+
+	return gh, nil
+}
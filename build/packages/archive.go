@@ -0,0 +1,85 @@
+package packages
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/cynix/freebsd-binaries/build/utils"
+	"github.com/mholt/archives"
+)
+
+// archive creates dist/<tarball> from the binaries built in dir, which are
+// stored by their base names, and the files in src matching the globs, which
+// are stored by their paths. Both dir and the globs are relative to src.
+func archive(core utils.Core, tarball, dir string, binaries, globs []string) error {
+	root, err := os.OpenRoot("src")
+	if err != nil {
+		return err
+	}
+
+	var files []archives.FileInfo
+
+	for _, bin := range binaries {
+		bin = path.Join(dir, bin)
+		fi := archives.FileInfo{
+			NameInArchive: path.Base(bin),
+			Open:          func() (fs.File, error) { return root.Open(bin) },
+		}
+
+		core.Info("Adding %q as %q", bin, fi.NameInArchive)
+
+		if fi.FileInfo, err = root.Stat(bin); err != nil {
+			return err
+		}
+		if fi.Mode().Perm()&0o111 != 0o111 {
+			return fmt.Errorf("not an executable: %q", bin)
+		}
+
+		files = append(files, fi)
+	}
+
+	for _, glob := range globs {
+		core.Info("Globbing %q", glob)
+
+		found, err := doublestar.Glob(root.FS(), glob, doublestar.WithFailOnIOErrors(), doublestar.WithFilesOnly())
+		if err != nil {
+			return fmt.Errorf("could not glob %q: %w", glob, err)
+		}
+
+		for _, file := range found {
+			core.Info("Adding %q", file)
+
+			fi := archives.FileInfo{
+				NameInArchive: file,
+				Open:          func() (fs.File, error) { return root.Open(file) },
+			}
+
+			if fi.FileInfo, err = root.Stat(file); err != nil {
+				return err
+			}
+
+			files = append(files, fi)
+		}
+	}
+
+	if err := os.MkdirAll("dist", 0o755); err != nil {
+		return fmt.Errorf("could not create dist dir: %w", err)
+	}
+
+	f, err := os.Create(path.Join("dist", tarball))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	format := archives.CompressedArchive{
+		Compression: archives.Gz{CompressionLevel: 2},
+		Archival:    archives.Tar{NumericUIDGID: true, Uid: 0, Gid: 0},
+	}
+
+	return format.Archive(context.TODO(), f, files)
+}
@@ -0,0 +1,283 @@
+package packages
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/bobg/go-generics/v4/slices"
+	"github.com/cynix/freebsd-binaries/build/project"
+	"github.com/cynix/freebsd-binaries/build/schema"
+	"github.com/cynix/freebsd-binaries/build/utils"
+)
+
+// Systems are the build systems that C and C++ packages are built with.
+const (
+	SystemCMake     = "cmake"
+	SystemMeson     = "meson"
+	SystemAutotools = "autotools"
+	SystemMake      = "make"
+)
+
+var Systems = []string{SystemCMake, SystemMeson, SystemAutotools, SystemMake}
+
+type CProject struct {
+	PackageProjectOf[CPackage, CConfig, *CPackage] `yaml:",inline"`
+}
+
+// CPackage is a package whose binaries are relative to the build dir, or to
+// the source for make, and are archived by their base names.
+type CPackage struct {
+	CConfig     `yaml:",inline"`
+	PackageBase `yaml:",inline"`
+}
+
+type CConfig struct {
+	System string
+	// Options are passed to cmake, meson setup, configure or make.
+	Options []string
+	Files   []string
+}
+
+func (cp *CProject) JSONSchema(g *schema.Generator) *schema.Schema {
+	return cp.schema(g.Struct(cp), "c")
+}
+
+func (cp *CPackage) Validate(v *project.Validator, at project.Path) {
+	bins := make(map[string]bool)
+
+	for i, bin := range cp.Binaries {
+		if !filepath.IsLocal(bin) {
+			v.Errorf(at.Key("binaries").Index(i), "binary is not relative: %q", bin)
+		} else if bins[path.Base(bin)] {
+			v.Errorf(at.Key("binaries").Index(i), "duplicate binary: %q", path.Base(bin))
+		}
+
+		bins[path.Base(bin)] = true
+	}
+
+	switch cp.System {
+	case "":
+		v.Errorf(at, "no system specified")
+	case SystemCMake, SystemMeson, SystemAutotools, SystemMake:
+	default:
+		v.Errorf(at.Key("system"), "unsupported system: %q", cp.System)
+	}
+
+	for i, glob := range cp.Files {
+		if !doublestar.ValidatePattern(glob) {
+			v.Errorf(at.Key("files").Index(i), "invalid pattern: %q", glob)
+		}
+	}
+}
+
+func (*CPackage) tarball() string {
+	return "{package}-v{version}-{triple}.tar.gz"
+}
+
+func (cp *CPackage) JSONSchema(g *schema.Generator) *schema.Schema {
+	s := g.Struct(cp)
+	s.Properties["extends"] = project.ExtendsSchema()
+	s.Properties["system"] = &schema.Schema{Type: "string", Enum: Systems}
+	return s
+}
+
+func (cc *CConfig) JSONSchema(g *schema.Generator) *schema.Schema {
+	s := g.Struct(cc)
+	s.Properties["system"] = &schema.Schema{Type: "string", Enum: Systems}
+	return s
+}
+
+func (cp *CPackage) Build(core utils.Core, r utils.Runner, pp *PackageProject, name, version string, pi PkgInfo) error {
+	// Plain make builds in the source tree, so archs cannot overlap.
+	n := pp.Resources.MaxArchs
+	if cp.System == SystemMake {
+		n = 1
+	}
+
+	if err := utils.Parallel(core, r, n, pp.Arch, func(core utils.Core, arch string) error {
+		return cp.build(core, r, pp.Settings.Dockcross(), name, version, arch, pi)
+	}); err != nil {
+		return err
+	}
+
+	return writeChecksums(core, r, fmt.Sprintf("%s-v%s-", name, version))
+}
+
+func (cp *CPackage) build(core utils.Core, r utils.Runner, dockcross, name, version, arch string, pi PkgInfo) error {
+	a, err := project.LookupArch(arch)
+	if err != nil {
+		return err
+	}
+
+	triple, sysroot := a.Triple, a.Sysroot
+
+	// Each arch is built out of tree, except with plain make.
+	dir := path.Join("_build", triple)
+	flags := fmt.Sprintf("--target=%s --sysroot=%s", a.Target, sysroot)
+	jobs := fmt.Sprintf("-j%d", runtime.NumCPU())
+
+	env := []string{
+		"CC=clang",
+		"CXX=clang++",
+		"AR=llvm-ar",
+		"RANLIB=llvm-ranlib",
+		"STRIP=llvm-strip",
+		"CFLAGS=-O2 " + flags,
+		"CXXFLAGS=-O2 " + flags,
+		"LDFLAGS=-s -fuse-ld=lld " + flags,
+		"PKG_CONFIG_LIBDIR=" + sysroot + "/usr/libdata/pkgconfig:" + sysroot + "/usr/local/libdata/pkgconfig",
+		"PKG_CONFIG_PATH=",
+		"PKG_CONFIG_SYSROOT_DIR=" + sysroot,
+	}
+
+	dx := &utils.Dockcross{Image: dockcross, Arch: arch, Runner: r}
+	command := func(name string, args ...string) *utils.Cmd {
+		return utils.Command(name, args...).In("src").WithEnv(env...).Via(dx)
+	}
+
+	var cmds []*utils.Cmd
+
+	switch cp.System {
+	case SystemCMake:
+		cmds = append(cmds, command("cmake", append([]string{
+			"-S", ".",
+			"-B", dir,
+			"-DCMAKE_BUILD_TYPE=Release",
+			"-DCMAKE_SYSTEM_NAME=FreeBSD",
+			"-DCMAKE_SYSTEM_PROCESSOR=" + a.CPU,
+			"-DCMAKE_SYSROOT=" + sysroot,
+			"-DCMAKE_C_COMPILER_TARGET=" + a.Target,
+			"-DCMAKE_CXX_COMPILER_TARGET=" + a.Target,
+			"-DCMAKE_FIND_ROOT_PATH_MODE_PROGRAM=NEVER",
+			"-DCMAKE_FIND_ROOT_PATH_MODE_LIBRARY=ONLY",
+			"-DCMAKE_FIND_ROOT_PATH_MODE_INCLUDE=ONLY",
+			"-DCMAKE_FIND_ROOT_PATH_MODE_PACKAGE=ONLY",
+		}, cp.Options...)...))
+		cmds = append(cmds, command("cmake", "--build", dir, "--parallel", fmt.Sprint(runtime.NumCPU())))
+
+	case SystemMeson:
+		cross := dir + ".ini"
+		b := []byte(mesonCrossFile(a))
+
+		if err := utils.Perform(r, utils.Step{Action: "write", Target: path.Join("src", cross), Detail: string(b)}, func() error {
+			if err := os.MkdirAll(path.Dir(path.Join("src", cross)), 0o755); err != nil {
+				return err
+			}
+
+			return os.WriteFile(path.Join("src", cross), b, 0o644)
+		}); err != nil {
+			return fmt.Errorf("could not write %q: %w", cross, err)
+		}
+
+		cmds = append(cmds, command("meson", append([]string{"setup", "--cross-file=" + cross, "--buildtype=release"}, append(cp.Options, dir)...)...))
+		cmds = append(cmds, command("meson", "compile", "-C", dir))
+
+	case SystemAutotools:
+		if _, err := os.Stat("src/configure"); err != nil {
+			cmds = append(cmds, command("autoreconf", "-fi"))
+		}
+
+		// configure is run from the build dir for an out of tree build.
+		cmds = append(cmds, command("/bin/sh", append([]string{
+			"-c", `dir=$1; shift; mkdir -p "$dir" && cd "$dir" && "$OLDPWD/configure" "$@"`,
+			"configure",
+			dir,
+			"--host=" + a.Target,
+			"--prefix=/usr/local",
+		}, cp.Options...)...))
+		cmds = append(cmds, command("make", "-C", dir, jobs))
+
+	case SystemMake:
+		dir = "."
+		cmds = append(cmds, command("make", append([]string{"-B", jobs}, cp.Options...)...))
+
+	default:
+		return fmt.Errorf("unsupported system: %q", cp.System)
+	}
+
+	if err := core.Group(fmt.Sprintf("Building %s package", arch), func() error {
+		for _, cmd := range cmds {
+			if err := cmd.Run(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return fmt.Errorf("could not build %s package: %w", arch, err)
+	}
+
+	tarball := fmt.Sprintf("%s-v%s-%s.tar.gz", name, version, triple)
+	step := utils.Step{
+		Action: "archive",
+		Target: path.Join("dist", tarball),
+		Detail: strings.Join(append(slices.Map(cp.Binaries, func(bin string) string {
+			return path.Join("src", dir, bin)
+		}), slices.Map(cp.Files, func(glob string) string {
+			return path.Join("src", glob)
+		})...), "\n"),
+	}
+
+	if err := core.Group("Creating "+tarball, func() error {
+		return utils.Perform(r, step, func() error { return archive(core, tarball, dir, cp.Binaries, cp.Files) })
+	}); err != nil {
+		return fmt.Errorf("could not create %q: %w", tarball, err)
+	}
+
+	if err := pi.Write(core, r, tarball, arch); err != nil {
+		return err
+	}
+
+	return pi.WriteSBOMs(core, r, tarball, "")
+}
+
+// mesonCrossFile returns the meson cross file for a FreeBSD arch.
+func mesonCrossFile(a project.Arch) string {
+	args := fmt.Sprintf("['--target=%s', '--sysroot=%s']", a.Target, a.Sysroot)
+	link := fmt.Sprintf("['--target=%s', '--sysroot=%s', '-fuse-ld=lld', '-s']", a.Target, a.Sysroot)
+
+	return fmt.Sprintf(`[binaries]
+c = 'clang'
+cpp = 'clang++'
+ar = 'llvm-ar'
+strip = 'llvm-strip'
+pkg-config = 'pkg-config'
+
+[built-in options]
+c_args = %[1]s
+cpp_args = %[1]s
+c_link_args = %[2]s
+cpp_link_args = %[2]s
+
+[properties]
+sys_root = '%[3]s'
+pkg_config_libdir = ['%[3]s/usr/libdata/pkgconfig', '%[3]s/usr/local/libdata/pkgconfig']
+
+[host_machine]
+system = 'freebsd'
+cpu_family = '%[4]s'
+cpu = '%[4]s'
+endian = 'little'
+`, args, link, a.Sysroot, a.CPU)
+}
+
+func (c *CConfig) Hydrate(defaults CConfig) {
+	if c.System == "" {
+		c.System = defaults.System
+	}
+
+	if len(c.Options) == 0 {
+		c.Options = slices.Clone(defaults.Options)
+	}
+
+	if len(c.Files) == 0 {
+		if c.Files = slices.Clone(defaults.Files); len(c.Files) == 0 {
+			c.Files = []string{"COPYING*", "LICENSE*"}
+		}
+	}
+}
@@ -1,13 +1,25 @@
 package packages
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/cynix/freebsd-binaries/build/container"
 	"github.com/cynix/freebsd-binaries/build/project"
+	"github.com/cynix/freebsd-binaries/build/registry"
+	"github.com/cynix/freebsd-binaries/build/schema"
 	"github.com/cynix/freebsd-binaries/build/utils"
 	"github.com/cynix/freebsd-binaries/build/version"
+	"github.com/goccy/go-yaml"
+	"github.com/google/go-github/v74/github"
 )
 
 type PackageProject struct {
@@ -16,6 +28,41 @@ type PackageProject struct {
 	Builder             string
 }
 
+// packageConfig is a package of a builder whose config is C, which is a
+// pointer to P.
+type packageConfig[P, C any] interface {
+	*P
+	Hydrate(defaults C)
+	Validate(v *project.Validator, at project.Path)
+	Build(core utils.Core, r utils.Runner, pp *PackageProject, name, version string, pi PkgInfo) error
+	base() *PackageBase
+	// tarball is the name of the archive of each arch, with the same
+	// placeholders as container assets.
+	tarball() string
+}
+
+// PackageBase is what the packages of every builder have besides their
+// config.
+type PackageBase struct {
+	Binaries  []string
+	Container *ContainerConfig
+}
+
+func (pb *PackageBase) base() *PackageBase {
+	return pb
+}
+
+// PackageProjectOf is a project of packages of type P, whose config is C, and
+// which may each have a container.
+type PackageProjectOf[P any, C any, PC packageConfig[P, C]] struct {
+	PackageProject `yaml:",inline"`
+	Packages       map[string]P
+	Defaults       struct {
+		Package   C
+		Container ContainerConfig
+	}
+}
+
 type RustConfig struct {
 	Toolchain string
 	Manifest  string
@@ -28,7 +75,287 @@ type ContainerConfig struct {
 	Files                     []container.ArchiveFile
 }
 
-func (pp *PackageProject) ApplyPatches(core utils.Core) error {
+func (pp *PackageProject) Validate(v *project.Validator, at project.Path) {
+	pp.BaseProject.Validate(v, at)
+	v.Patch(pp.Name)
+
+	if pp.Source.Repo == "" {
+		v.Errorf(at, "no source specified")
+	}
+}
+
+func (cc ContainerConfig) Validate(v *project.Validator, at project.Path) {
+	// The first asset is the package archive injected by Hydrate.
+	conf := cc.ContainerConfig
+	conf.Assets = conf.Assets[min(1, len(conf.Assets)):]
+	conf.Validate(v, at)
+
+	for i, af := range cc.Files {
+		if af.Src == "" {
+			v.Errorf(at.Key("files").Index(i), "missing src")
+		}
+
+		if af.Dst != "" && !strings.HasPrefix(af.Dst, "/") {
+			v.Errorf(at.Key("files").Index(i).Key("dst"), "destination is not absolute: %q", af.Dst)
+		}
+	}
+}
+
+// hydrate fills in the container of a package from defaults, and deploys the
+// binaries from the package archive at url before any other asset.
+func (cc *ContainerConfig) hydrate(defaults ContainerConfig, url string, binaries []string) {
+	cc.Hydrate(defaults.ContainerConfig)
+
+	if len(cc.Files) == 0 {
+		cc.Files = defaults.Files
+	}
+
+	aa := &container.ArchiveAsset{URLAsset: container.URLAsset{URL: url}}
+
+	for _, bin := range binaries {
+		aa.Files = append(aa.Files, container.ArchiveFile{Src: path.Base(bin)})
+	}
+
+	aa.Files = append(aa.Files, cc.Files...)
+	cc.Assets = slices.Insert(cc.Assets, 0, container.Asset{Deployable: aa})
+}
+
+func (pp *PackageProjectOf[P, C, PC]) Hydrate(name string, s project.Settings) {
+	pp.Name, pp.Settings = name, s
+	pp.Resources.Hydrate()
+
+	if len(pp.Arch) == 0 {
+		pp.Arch = slices.Clone(project.DefaultArchs)
+	}
+
+	if len(pp.Packages) == 0 {
+		pp.Packages = map[string]P{name: *new(P)}
+	}
+
+	for k, v := range pp.Packages {
+		pkg := PC(&v)
+		pb := pkg.base()
+
+		if len(pb.Binaries) == 0 {
+			pb.Binaries = []string{k}
+		}
+
+		pkg.Hydrate(pp.Defaults.Package)
+
+		if pb.Container != nil {
+			pb.Container.hydrate(pp.Defaults.Container, s.ReleaseURL("{project}-v{version}")+"/"+pkg.tarball(), pb.Binaries)
+		}
+
+		pp.Packages[k] = v
+	}
+}
+
+// schema completes the schema of a project built by one of builders.
+func (pp *PackageProject) schema(s *schema.Schema, builders ...string) *schema.Schema {
+	s = project.BaseSchema(s)
+	s.Properties["builder"] = &schema.Schema{Type: "string", Enum: builders}
+	return project.RequireSchema(s, "source", "builder")
+}
+
+// pkg returns a copy of package name.
+func (pp *PackageProjectOf[P, C, PC]) pkg(name string) (PC, bool) {
+	v, ok := pp.Packages[name]
+	return PC(&v), ok
+}
+
+func (pp *PackageProjectOf[P, C, PC]) Job(gh *github.Client) (j project.ProjectJob, err error) {
+	j.Project = pp.Name
+
+	var ref string
+	if ref, j.Version, err = pp.Source.RefVersion(gh); err != nil {
+		return
+	}
+
+	for _, k := range slices.Sorted(maps.Keys(pp.Packages)) {
+		j.Packages = append(j.Packages, project.PackageJob{Package: k, Builder: pp.Builder, Repo: pp.Source.Repo, Ref: ref})
+	}
+
+	j.Containers = pp.Containers()
+	return
+}
+
+func (pp *PackageProjectOf[P, C, PC]) Resolve(gh *github.Client) (res project.Resolution, err error) {
+	if res, err = pp.PackageProject.Resolve(gh); err != nil {
+		return
+	}
+
+	for _, k := range pp.Containers() {
+		pkg, _ := pp.pkg(k)
+
+		var assets []project.ResolvedAsset
+		if assets, err = pp.containerProject(pkg.base().Container).ResolveAssets(gh, res.Version, k); err != nil {
+			return
+		}
+
+		res.Assets = append(res.Assets, assets...)
+	}
+
+	return
+}
+
+func (pp *PackageProjectOf[P, C, PC]) BuildPackage(core utils.Core, gh *github.Client, r utils.Runner, version, name string) error {
+	pkg, ok := pp.pkg(name)
+	if !ok {
+		return fmt.Errorf("unknown package: %q", name)
+	}
+
+	if err := pp.ApplyPatches(core, r); err != nil {
+		return err
+	}
+
+	return pkg.Build(core, r, &pp.PackageProject, name, version, pp.pkgInfo(name, version, pkg.base().Binaries, pkg.base().Container))
+}
+
+func (pp *PackageProjectOf[P, C, PC]) BuildContainer(core utils.Core, gh *github.Client, r utils.Runner, version, name string) error {
+	pkg, ok := pp.pkg(name)
+	if !ok {
+		return fmt.Errorf("unknown package: %q", name)
+	}
+
+	if pkg.base().Container == nil {
+		return fmt.Errorf("not building container for package: %q", name)
+	}
+
+	return pp.containerProject(pkg.base().Container).BuildContainer(core, gh, r, version, name)
+}
+
+func (pp *PackageProjectOf[P, C, PC]) Containers() (names []string) {
+	for _, k := range slices.Sorted(maps.Keys(pp.Packages)) {
+		if pkg, _ := pp.pkg(k); pkg.base().Container != nil {
+			names = append(names, k)
+		}
+	}
+
+	return
+}
+
+func (pp *PackageProjectOf[P, C, PC]) Requires() (reqs []project.Requirement) {
+	for _, k := range pp.Containers() {
+		pkg, _ := pp.pkg(k)
+		reqs = append(reqs, pkg.base().Container.Requires(pp.Settings, pp.Name, k)...)
+	}
+
+	return
+}
+
+// Fingerprint returns a digest of what the packages are built from besides
+// their source. Containers are left out, as they are built separately.
+func (pp *PackageProjectOf[P, C, PC]) Fingerprint() (string, error) {
+	pkgs := make(map[string]P, len(pp.Packages))
+
+	for k, v := range pp.Packages {
+		PC(&v).base().Container = nil
+		pkgs[k] = v
+	}
+
+	return pp.fingerprint(pkgs)
+}
+
+func (pp *PackageProjectOf[P, C, PC]) RebuildReason(gh *github.Client, reg *registry.Client, version, name string) string {
+	pkg, ok := pp.pkg(name)
+	if !ok || pkg.base().Container == nil {
+		return fmt.Sprintf("no such container: %q", name)
+	}
+
+	return pp.containerProject(pkg.base().Container).RebuildReason(gh, reg, version, name)
+}
+
+func (pp *PackageProjectOf[P, C, PC]) Validate(v *project.Validator, at project.Path) {
+	pp.PackageProject.Validate(v, at)
+
+	for _, k := range slices.Sorted(maps.Keys(pp.Packages)) {
+		pkg, _ := pp.pkg(k)
+		at := at.Key("packages").Key(k)
+
+		if len(pkg.base().Binaries) == 0 {
+			v.Errorf(at, "no binaries defined")
+		}
+
+		pkg.Validate(v, at)
+
+		if c := pkg.base().Container; c != nil {
+			v.Root(k)
+			c.Validate(v, at.Key("container"))
+		}
+	}
+}
+
+func (pp *PackageProject) Upstream(gh *github.Client) (up project.Upstream, err error) {
+	var ref string
+	if ref, up.Version, err = pp.Source.RefVersion(gh); err != nil {
+		return
+	}
+
+	var since time.Time
+	if up.Commits, since, err = pp.Source.CommitsBehind(gh); err != nil || up.Commits > 0 {
+		up.Date = since
+		return
+	}
+
+	up.Date, err = pp.Source.RefDate(gh, ref)
+	return
+}
+
+func (pp *PackageProject) Resolve(gh *github.Client) (res project.Resolution, err error) {
+	res.Ref, res.Version, err = pp.Source.RefVersion(gh)
+	return
+}
+
+func (pp *PackageProject) Sources() []version.RepoRef {
+	return []version.RepoRef{pp.Source}
+}
+
+// containerProject returns the project that builds a package's container.
+func (pp *PackageProject) containerProject(conf *ContainerConfig) *container.ContainerProject {
+	c := &container.ContainerProject{
+		BaseProject: pp.BaseProject,
+		Container:   conf.ContainerConfig,
+	}
+	c.Hydrate(pp.Name, pp.Settings)
+
+	return c
+}
+
+// fingerprint returns a digest of the config of packages and the patches
+// applied to them, which is everything besides the source that a package
+// release is built from.
+func (pp *PackageProject) fingerprint(packages any) (string, error) {
+	b, err := yaml.Marshal(struct {
+		Arch     []string
+		Source   version.RepoRef
+		Builder  string
+		Packages any
+	}{pp.Arch, pp.Source, pp.Builder, packages})
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write(b)
+
+	patches, err := filepath.Glob(pp.Name + "/*.patch")
+	if err != nil {
+		return "", err
+	}
+
+	for _, patch := range patches {
+		b, err := os.ReadFile(patch)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(h, "%s\x00%s\x00", filepath.Base(patch), b)
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (pp *PackageProject) ApplyPatches(core utils.Core, r utils.Runner) error {
 	patches, err := filepath.Glob(pp.Name + "/*.patch")
 	if err != nil {
 		return err
@@ -42,7 +369,7 @@ func (pp *PackageProject) ApplyPatches(core utils.Core) error {
 		defer f.Close()
 
 		if err = core.Group("Applying "+patch, func() error {
-			return utils.Command("patch", "-p1").In("src").WithInput(f).Run()
+			return utils.Command("patch", "-p1").In("src").WithInput(f).Via(r).Run()
 		}); err != nil {
 			return err
 		}
@@ -2,31 +2,25 @@ package packages
 
 import (
 	"fmt"
-	"maps"
 	"os"
 	"strings"
+	"text/template"
 
+	"github.com/bmatcuk/doublestar/v4"
 	"github.com/bobg/go-generics/v4/slices"
-	"github.com/cynix/freebsd-binaries/build/container"
 	"github.com/cynix/freebsd-binaries/build/project"
+	"github.com/cynix/freebsd-binaries/build/schema"
 	"github.com/cynix/freebsd-binaries/build/utils"
 	"github.com/goccy/go-yaml"
-	"github.com/google/go-github/v74/github"
 )
 
 type GoProject struct {
-	PackageProject `yaml:",inline"`
-	Packages       map[string]GoPackage
-	Defaults       struct {
-		Package   GoConfig
-		Container ContainerConfig
-	}
+	PackageProjectOf[GoPackage, GoConfig, *GoPackage] `yaml:",inline"`
 }
 
 type GoPackage struct {
-	GoConfig  `yaml:",inline"`
-	Binaries  []string
-	Container *ContainerConfig
+	GoConfig    `yaml:",inline"`
+	PackageBase `yaml:",inline"`
 }
 
 type GoConfig struct {
@@ -36,145 +30,101 @@ type GoConfig struct {
 	Tags    []string
 	Before  []string
 	Files   []string
+	// Native builds with go build rather than goreleaser.
+	Native bool
 }
 
-func (gp *GoProject) Hydrate(name string) {
-	gp.Name = name
-
-	if len(gp.Arch) == 0 {
-		gp.Arch = []string{"amd64", "arm64"}
-	}
-
-	if len(gp.Packages) == 0 {
-		gp.Packages = map[string]GoPackage{name: {}}
-	}
-
-	for k, v := range gp.Packages {
-		if len(v.Binaries) == 0 {
-			v.Binaries = []string{k}
-		}
-
-		v.Hydrate(gp.Defaults.Package)
-
-		if v.Container != nil {
-			v.Container.Hydrate(gp.Defaults.Container.ContainerConfig)
-
-			if len(v.Container.Files) == 0 {
-				v.Container.Files = gp.Defaults.Container.Files
-			}
-
-			aa := &container.ArchiveAsset{
-				URLAsset: container.URLAsset{
-					URL: "https://github.com/cynix/freebsd-binaries/releases/download/{project}-v{version}/{package}-{version}-freebsd_{arch}.tar.gz",
-				},
-			}
-
-			for _, bin := range v.Binaries {
-				aa.Files = append(aa.Files, container.ArchiveFile{Src: bin})
-			}
-
-			aa.Files = append(aa.Files, v.Container.Files...)
-			v.Container.Assets = slices.Insert(v.Container.Assets, 0, container.Asset{Deployable: aa})
-		}
-
-		gp.Packages[k] = v
-	}
+func (gp *GoProject) JSONSchema(g *schema.Generator) *schema.Schema {
+	return gp.schema(g.Struct(gp), "go", "cgo")
 }
 
-func (gp *GoProject) Job(gh *github.Client) (j project.ProjectJob, err error) {
-	j.Project = gp.Name
+func (gc GoConfig) Validate(v *project.Validator, at project.Path) {
+	v.Placeholders(at.Key("main"), gc.Main, "binary")
 
-	var ref string
-	if ref, j.Version, err = gp.Source.RefVersion(gh); err != nil {
-		return
+	for i, s := range gc.Ldflags {
+		validateTemplate(v, at.Key("ldflags").Index(i), s)
 	}
 
-	for _, k := range slices.Sorted(maps.Keys(gp.Packages)) {
-		j.Packages = append(j.Packages, project.PackageJob{Package: k, Builder: gp.Builder, Repo: gp.Source.Repo, Ref: ref})
+	for i, s := range gc.Before {
+		validateTemplate(v, at.Key("before").Index(i), s)
+	}
 
-		if gp.Packages[k].Container != nil {
-			j.Containers = append(j.Containers, k)
+	for i, glob := range gc.Files {
+		if !doublestar.ValidatePattern(glob) {
+			v.Errorf(at.Key("files").Index(i), "invalid pattern: %q", glob)
 		}
 	}
-
-	return
 }
 
-func (gp *GoProject) BuildPackage(core utils.Core, gh *github.Client, version, name string) error {
-	pkg, ok := gp.Packages[name]
-	if !ok {
-		return fmt.Errorf("unknown package: %q", name)
-	}
+func (*GoPackage) tarball() string {
+	return "{package}-{version}-freebsd_{arch}.tar.gz"
+}
 
-	if err := gp.ApplyPatches(core); err != nil {
-		return err
+func validateTemplate(v *project.Validator, at project.Path, s string) {
+	if _, err := template.New("").Parse(s); err != nil {
+		v.Errorf(at, "invalid template %q: %v", s, err)
 	}
-
-	return pkg.Build(core, name, version, gp.Arch, gp.Builder == "cgo")
 }
 
-func (gp *GoProject) BuildContainer(core utils.Core, gh *github.Client, version, name string) error {
-	pkg, ok := gp.Packages[name]
-	if !ok {
-		return fmt.Errorf("unknown package: %q", name)
-	}
+func (gp *GoPackage) JSONSchema(g *schema.Generator) *schema.Schema {
+	s := g.Struct(gp)
+	s.Properties["extends"] = project.ExtendsSchema()
+	return s
+}
 
-	if pkg.Container == nil {
-		return fmt.Errorf("not building container for package: %q", name)
-	}
+func (gp *GoPackage) Build(core utils.Core, r utils.Runner, pp *PackageProject, name, version string, pi PkgInfo) error {
+	dockcross, arch, cgo := pp.Settings.Dockcross(), pp.Arch, pp.Builder == "cgo"
 
-	c := container.ContainerProject{
-		BaseProject: gp.BaseProject,
-		Container:   pkg.Container.ContainerConfig,
+	if gp.Native {
+		return gp.buildNative(core, r, dockcross, name, version, arch, pp.Resources.MaxArchs, cgo, pi)
 	}
-	c.Hydrate(gp.Name)
 
-	return c.BuildContainer(core, gh, version, name)
-}
-
-func (gp *GoPackage) Build(core utils.Core, name, version string, arch []string, cgo bool) error {
 	gr := goReleaser{
 		Version:     2,
 		ProjectName: name,
 		Dist:        "../dist",
-		Archives: []goReleaserArchive{
-			{
-				Formats:      []string{"tar.gz"},
-				NameTemplate: "{{ .ProjectName }}-{{ .Version }}-{{ .Os }}_{{ .Arch }}{{ with .Arm }}v{{ . }}{{ end }}{{ with .Mips }}_{{ . }}{{ end }}{{ if not (eq .Amd64 \"v1\") }}{{ .Amd64 }}{{ end }}",
-				Files:        gp.Files,
-			},
-		},
 	}
 
 	gr.Release.Disable = true
 	gr.Before.Hooks = gp.Before
 
-	for _, bin := range gp.Binaries {
-		gb := goReleaserBuild{
-			Id:      bin,
-			Binary:  bin,
-			Main:    strings.ReplaceAll(gp.Main, "{binary}", bin),
-			Flags:   append(gp.Flags, "-trimpath"),
-			Ldflags: append(gp.Ldflags, "-buildid=", "-extldflags=-static", "-s", "-w"),
-			Tags:    gp.Tags,
-			Targets: slices.Map(arch, func(s string) string { return "freebsd_" + s }),
+	// Each arch is built and archived separately, so that its environment
+	// and archive name come from the arch table rather than templates.
+	for _, s := range arch {
+		a, err := project.LookupArch(s)
+		if err != nil {
+			return err
+		}
+
+		target := "freebsd_" + a.GoArch
+		if a.GoArm != "" {
+			target += "_" + a.GoArm
+		}
+
+		ga := goReleaserArchive{
+			Id:           a.Name,
+			Formats:      []string{"tar.gz"},
+			NameTemplate: "{{ .ProjectName }}-{{ .Version }}-{{ .Os }}_" + a.Name,
+			Files:        gp.Files,
 		}
 
-		if cgo {
-			gb.Env = []string{
-				"CGO_ENABLED=1",
-				"CGO_CFLAGS=--target={{ if eq .Arch \"amd64\" }}x86_64{{ else }}aarch64{{ end }}-unknown-freebsd --sysroot=/freebsd/{{ if eq .Arch \"amd64\" }}amd64{{ else }}aarch64{{ end }}",
-				"CGO_CXXFLAGS=--target={{ if eq .Arch \"amd64\" }}x86_64{{ else }}aarch64{{ end }}-unknown-freebsd --sysroot=/freebsd/{{ if eq .Arch \"amd64\" }}amd64{{ else }}aarch64{{ end }}",
-				"CGO_LDFLAGS=--target={{ if eq .Arch \"amd64\" }}x86_64{{ else }}aarch64{{ end }}-unknown-freebsd --sysroot=/freebsd/{{ if eq .Arch \"amd64\" }}amd64{{ else }}aarch64{{ end }} -fuse-ld=lld",
-				"PKG_CONFIG_LIBDIR=/freebsd/{{ if eq .Arch \"amd64\" }}amd64{{ else }}aarch64{{ end }}/usr/libdata/pkgconfig:/freebsd/{{ if eq .Arch \"amd64\" }}amd64{{ else }}aarch64{{ end }}/usr/local/libdata/pkgconfig",
-				"PKG_CONFIG_PATH=",
-				"PKG_CONFIG_SYSROOT_DIR=/freebsd/{{ if eq .Arch \"amd64\" }}amd64{{ else }}aarch64{{ end }}",
+		for _, bin := range gp.Binaries {
+			gb := goReleaserBuild{
+				Id:      bin + "_" + a.Name,
+				Binary:  bin,
+				Main:    strings.ReplaceAll(gp.Main, "{binary}", bin),
+				Flags:   append(gp.Flags, "-trimpath"),
+				Ldflags: append(gp.Ldflags, "-buildid=", "-extldflags=-static", "-s", "-w"),
+				Tags:    gp.Tags,
+				Targets: []string{target},
+				Env:     cgoEnv(a, cgo),
 			}
-		} else {
-			gb.Env = []string{"CGO_ENABLED=0"}
+
+			ga.Ids = append(ga.Ids, gb.Id)
+			gr.Builds = append(gr.Builds, gb)
 		}
 
-		gr.Builds = append(gr.Builds, gb)
+		gr.Archives = append(gr.Archives, ga)
 	}
 
 	b, err := yaml.Marshal(gr)
@@ -187,22 +137,42 @@ func (gp *GoPackage) Build(core utils.Core, name, version string, arch []string,
 		return nil
 	})
 
-	if err := os.WriteFile(".goreleaser.yaml", b, 0o644); err != nil {
+	if err := utils.Perform(r, utils.Step{Action: "write", Target: ".goreleaser.yaml", Detail: string(b)}, func() error {
+		return os.WriteFile(".goreleaser.yaml", b, 0o644)
+	}); err != nil {
 		return fmt.Errorf("could not write .goreleaser.yaml: %w", err)
 	}
 
-	cmd := utils.Command("/bin/sh", "-c", "pwd && cd src && goreleaser release --config=../.goreleaser.yaml --clean --skip=validate").
-		WithEnv("GORELEASER_CURRENT_TAG=" + version)
+	release := "goreleaser release --config=../.goreleaser.yaml --clean --skip=validate"
+	if n := pp.Resources.MaxArchs; n > 0 {
+		release += fmt.Sprintf(" --parallelism=%d", n)
+	}
+
+	cmd := utils.Command("/bin/sh", "-c", "pwd && cd src && "+release).
+		WithEnv("GORELEASER_CURRENT_TAG=" + version).
+		Via(r)
 
 	if cgo {
-		cmd.Via(&utils.Dockcross{})
+		cmd.Via(&utils.Dockcross{Image: dockcross, Runner: r})
 	}
 
 	if err := core.Group("Building package", func() error { return cmd.Run() }); err != nil {
 		return fmt.Errorf("goreleaser failed: %w", err)
 	}
 
-	return nil
+	for _, a := range arch {
+		tarball := fmt.Sprintf("%s-%s-freebsd_%s.tar.gz", name, version, a)
+
+		if err := pi.Write(core, r, tarball, a); err != nil {
+			return err
+		}
+
+		if err := pi.WriteSBOMs(core, r, tarball, ""); err != nil {
+			return err
+		}
+	}
+
+	return writeChecksums(core, r, fmt.Sprintf("%s-%s-", name, version))
 }
 
 func (c *GoConfig) Hydrate(defaults GoConfig) {
@@ -233,9 +203,13 @@ func (c *GoConfig) Hydrate(defaults GoConfig) {
 			c.Files = []string{"COPYING*", "LICENSE*"}
 		}
 	}
+
+	c.Native = c.Native || defaults.Native
 }
 
 type goReleaserArchive struct {
+	Id           string   `yaml:"id"`
+	Ids          []string `yaml:"ids"`
 	Formats      []string `yaml:"formats"`
 	NameTemplate string   `yaml:"name_template"`
 	Files        []string `yaml:"files"`
@@ -0,0 +1,232 @@
+package packages
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bobg/go-generics/v4/slices"
+	"github.com/cynix/freebsd-binaries/build/project"
+	"github.com/cynix/freebsd-binaries/build/utils"
+)
+
+// goTemplate holds the fields available to the ldflags and before hooks of
+// native builds, named and filled in as in goreleaser. Date and Timestamp are
+// the build time, while CommitDate and CommitTimestamp keep rebuilds
+// reproducible.
+type goTemplate struct {
+	ProjectName     string
+	Version         string
+	Tag             string
+	Commit          string
+	FullCommit      string
+	ShortCommit     string
+	Branch          string
+	Date            string
+	Timestamp       int64
+	CommitDate      string
+	CommitTimestamp int64
+	Os              string
+	Arch            string
+	Arm             string
+	Env             map[string]string
+}
+
+// buildNative builds the package with go build, without goreleaser, into
+// tarballs named as goreleaser would.
+func (gp *GoPackage) buildNative(core utils.Core, r utils.Runner, dockcross, name, version string, arch []string, n int, cgo bool, pi PkgInfo) error {
+	data, err := gitTemplate(r, name, version)
+	if err != nil {
+		return fmt.Errorf("could not read commit: %w", err)
+	}
+
+	via := func(arch string) utils.Runner {
+		if cgo {
+			return &utils.Dockcross{Image: dockcross, Arch: arch, Runner: r}
+		}
+		return r
+	}
+
+	if err := core.Group("Running before hooks", func() error {
+		for _, hook := range gp.Before {
+			s, err := data.apply(hook)
+			if err != nil {
+				return err
+			}
+
+			if err := utils.Command("/bin/sh", "-c", s).In("src").Via(via("")).Run(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return fmt.Errorf("before hook failed: %w", err)
+	}
+
+	if err := utils.Parallel(core, r, n, arch, func(core utils.Core, a string) error {
+		return gp.buildArch(core, r, via(a), data, name, version, a, cgo, pi)
+	}); err != nil {
+		return err
+	}
+
+	return writeChecksums(core, r, fmt.Sprintf("%s-%s-", name, version))
+}
+
+func (gp *GoPackage) buildArch(core utils.Core, r, via utils.Runner, data goTemplate, name, version, arch string, cgo bool, pi PkgInfo) error {
+	a, err := project.LookupArch(arch)
+	if err != nil {
+		return err
+	}
+
+	data.Os, data.Arch, data.Arm = "freebsd", a.GoArch, a.GoArm
+
+	var ldflags []string
+
+	for _, s := range gp.Ldflags {
+		s, err := data.apply(s)
+		if err != nil {
+			return err
+		}
+
+		ldflags = append(ldflags, s)
+	}
+
+	ldflags = append(ldflags, "-buildid=", "-extldflags=-static", "-s", "-w")
+
+	env := append([]string{"GOOS=freebsd", "GOARCH=" + a.GoArch, "GOARM=" + a.GoArm}, cgoEnv(a, cgo)...)
+
+	dir := path.Join("_build", "freebsd_"+arch)
+
+	if err := core.Group(fmt.Sprintf("Building %s package", arch), func() error {
+		for _, bin := range gp.Binaries {
+			args := []string{"build", "-o", path.Join(dir, bin)}
+			args = append(args, gp.Flags...)
+			args = append(args, "-trimpath", "-ldflags="+strings.Join(ldflags, " "))
+
+			if len(gp.Tags) > 0 {
+				args = append(args, "-tags="+strings.Join(gp.Tags, ","))
+			}
+
+			args = append(args, strings.ReplaceAll(gp.Main, "{binary}", bin))
+
+			if err := utils.Command("go", args...).In("src").WithEnv(env...).Via(via).Run(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return fmt.Errorf("could not build %s package: %w", arch, err)
+	}
+
+	tarball := fmt.Sprintf("%s-%s-freebsd_%s.tar.gz", name, version, arch)
+	step := utils.Step{
+		Action: "archive",
+		Target: path.Join("dist", tarball),
+		Detail: strings.Join(append(slices.Map(gp.Binaries, func(bin string) string {
+			return path.Join("src", dir, bin)
+		}), slices.Map(gp.Files, func(glob string) string {
+			return path.Join("src", glob)
+		})...), "\n"),
+	}
+
+	if err := core.Group("Creating "+tarball, func() error {
+		return utils.Perform(r, step, func() error { return archive(core, tarball, dir, gp.Binaries, gp.Files) })
+	}); err != nil {
+		return fmt.Errorf("could not create %q: %w", tarball, err)
+	}
+
+	if err := pi.Write(core, r, tarball, arch); err != nil {
+		return err
+	}
+
+	return pi.WriteSBOMs(core, r, tarball, "")
+}
+
+// cgoEnv returns the cgo environment of Go builds for a, building against its
+// sysroot if enabled.
+func cgoEnv(a project.Arch, cgo bool) []string {
+	if !cgo {
+		return []string{"CGO_ENABLED=0"}
+	}
+
+	flags := fmt.Sprintf("--target=%s --sysroot=%s", a.Target, a.Sysroot)
+
+	return []string{
+		"CGO_ENABLED=1",
+		"CGO_CFLAGS=" + flags,
+		"CGO_CXXFLAGS=" + flags,
+		"CGO_LDFLAGS=" + flags + " -fuse-ld=lld",
+		"PKG_CONFIG_LIBDIR=" + a.Sysroot + "/usr/libdata/pkgconfig:" + a.Sysroot + "/usr/local/libdata/pkgconfig",
+		"PKG_CONFIG_PATH=",
+		"PKG_CONFIG_SYSROOT_DIR=" + a.Sysroot,
+	}
+}
+
+// gitTemplate returns the template fields describing the commit checked out
+// in src.
+func gitTemplate(r utils.Runner, name, version string) (data goTemplate, err error) {
+	data.ProjectName = name
+	data.Tag = version
+	data.Version = strings.TrimPrefix(version, "v")
+	data.Env = make(map[string]string)
+
+	for _, e := range os.Environ() {
+		if k, v, ok := strings.Cut(e, "="); ok {
+			data.Env[k] = v
+		}
+	}
+
+	var ts string
+
+	for _, x := range []struct {
+		format string
+		v      *string
+	}{{"%H", &data.FullCommit}, {"%h", &data.ShortCommit}, {"%ct", &ts}} {
+		if *x.v, err = utils.Command("git", "-C", "src", "log", "-1", "--format="+x.format).Via(r).First(); err != nil {
+			return
+		}
+	}
+
+	data.Commit = data.FullCommit
+
+	// Plans record placeholders rather than timestamps.
+	_, planning := r.(*utils.Recorder)
+
+	if data.CommitTimestamp, err = strconv.ParseInt(ts, 10, 64); err != nil {
+		if !planning {
+			return
+		}
+
+		err = nil
+	}
+
+	if !planning {
+		data.Timestamp = time.Now().Unix()
+	}
+
+	data.Date = time.Unix(data.Timestamp, 0).UTC().Format(time.RFC3339)
+	data.CommitDate = time.Unix(data.CommitTimestamp, 0).UTC().Format(time.RFC3339)
+
+	data.Branch, err = utils.Command("git", "-C", "src", "rev-parse", "--abbrev-ref", "HEAD").Via(r).First()
+	return
+}
+
+func (data goTemplate) apply(s string) (string, error) {
+	t, err := template.New("").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid template %q: %w", s, err)
+	}
+
+	var sb strings.Builder
+	if err := t.Execute(&sb, data); err != nil {
+		return "", fmt.Errorf("could not apply template %q: %w", s, err)
+	}
+
+	return sb.String(), nil
+}
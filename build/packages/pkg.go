@@ -0,0 +1,266 @@
+package packages
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cynix/freebsd-binaries/build/project"
+	"github.com/cynix/freebsd-binaries/build/utils"
+	"github.com/mholt/archives"
+)
+
+// pkgPrefix is where pkg packages install to. Binaries go in bin, and every
+// other file of a package in share/<package>.
+const pkgPrefix = "/usr/local"
+
+// PkgInfo describes the FreeBSD pkg packages that are built from the
+// tarballs of a package.
+type PkgInfo struct {
+	Name       string
+	Version    string
+	Origin     string
+	WWW        string
+	Maintainer string
+	FreeBSD    string
+	Binaries   []string
+	// User is created on install, as name=uid.
+	User string
+}
+
+type pkgManifest struct {
+	Name       string            `json:"name"`
+	Origin     string            `json:"origin"`
+	Version    string            `json:"version"`
+	Comment    string            `json:"comment"`
+	Maintainer string            `json:"maintainer"`
+	WWW        string            `json:"www"`
+	ABI        string            `json:"abi"`
+	Arch       string            `json:"arch"`
+	Prefix     string            `json:"prefix"`
+	FlatSize   int64             `json:"flatsize"`
+	Desc       string            `json:"desc"`
+	Users      []string          `json:"users,omitempty"`
+	Groups     []string          `json:"groups,omitempty"`
+	Files      map[string]string `json:"files,omitempty"`
+	Scripts    map[string]string `json:"scripts,omitempty"`
+}
+
+// pkgInfo returns what the pkg packages of package name are built with.
+func (pp *PackageProject) pkgInfo(name, version string, binaries []string, c *ContainerConfig) PkgInfo {
+	pi := PkgInfo{
+		Name:       name,
+		Version:    version,
+		Origin:     pp.Settings.Repo() + "/" + name,
+		WWW:        pp.Settings.GitHub.Server + "/" + pp.Source.Repo,
+		Maintainer: pp.Settings.Owner(),
+		FreeBSD:    pp.Settings.FreeBSD,
+		Binaries:   binaries,
+	}
+
+	if c != nil {
+		pi.User = c.User
+	}
+
+	return pi
+}
+
+// Write creates dist/<name>.pkg for arch from dist/<name>.tar.gz, in which
+// the binaries are at the top level.
+func (pi PkgInfo) Write(core utils.Core, r utils.Runner, tarball, arch string) error {
+	pkg := strings.TrimSuffix(tarball, ".tar.gz") + ".pkg"
+
+	if err := core.Group("Creating "+pkg, func() error {
+		return utils.Perform(r, utils.Step{Action: "pkg", Target: path.Join("dist", pkg), Detail: path.Join("dist", tarball)}, func() error {
+			return pi.write(core, path.Join("dist", tarball), path.Join("dist", pkg), arch)
+		})
+	}); err != nil {
+		return fmt.Errorf("could not create %q: %w", pkg, err)
+	}
+
+	return nil
+}
+
+func (pi PkgInfo) write(core utils.Core, src, dst, arch string) error {
+	m, err := pi.manifest(arch)
+	if err != nil {
+		return err
+	}
+
+	// The manifests come first, so the files are hashed before they are
+	// copied.
+	if err := pi.eachFile(src, func(name string, hdr *tar.Header, r io.Reader) error {
+		h := sha256.New()
+		if _, err := io.Copy(h, r); err != nil {
+			return err
+		}
+
+		core.Info("Adding %q as %q", hdr.Name, name)
+
+		m.Files[name] = "1$" + hex.EncodeToString(h.Sum(nil))
+		m.FlatSize += hdr.Size
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	full, err := m.marshal()
+	if err != nil {
+		return err
+	}
+
+	m.Files, m.Scripts = nil, nil
+
+	compact, err := m.marshal()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw, err := archives.Zstd{}.OpenWriter(f)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(zw)
+
+	for _, x := range []struct {
+		name string
+		b    []byte
+	}{{"+COMPACT_MANIFEST", compact}, {"+MANIFEST", full}} {
+		if err := tw.WriteHeader(&tar.Header{Name: x.name, Mode: 0o644, Size: int64(len(x.b)), Uname: "root", Gname: "wheel"}); err != nil {
+			return err
+		}
+
+		if _, err := tw.Write(x.b); err != nil {
+			return err
+		}
+	}
+
+	if err := pi.eachFile(src, func(name string, hdr *tar.Header, r io.Reader) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    hdr.Mode,
+			Size:    hdr.Size,
+			ModTime: hdr.ModTime,
+			Uname:   "root",
+			Gname:   "wheel",
+		}); err != nil {
+			return err
+		}
+
+		_, err := io.Copy(tw, r)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+func (pi PkgInfo) manifest(arch string) (m pkgManifest, err error) {
+	if m.ABI, err = project.PkgABI(pi.FreeBSD, arch); err != nil {
+		return
+	}
+
+	a, err := project.LookupArch(arch)
+	if err != nil {
+		return
+	}
+
+	m.Arch = fmt.Sprintf("freebsd:%s:%s", pi.FreeBSD, a.PkgArch)
+
+	m.Name = pi.Name
+	m.Origin = pi.Origin
+	// Hyphens separate the name from the version in pkg file names.
+	m.Version = strings.ReplaceAll(pi.Version, "-", ".")
+	m.Comment = fmt.Sprintf("%s built from %s", pi.Name, pi.WWW)
+	m.Desc = m.Comment
+	m.Maintainer = pi.Maintainer
+	m.WWW = pi.WWW
+	m.Prefix = pkgPrefix
+	m.Files = make(map[string]string)
+
+	if user, uid, _ := strings.Cut(pi.User, "="); uid != "" {
+		m.Users, m.Groups = []string{user}, []string{user}
+		m.Scripts = map[string]string{
+			"pre-install": fmt.Sprintf(
+				"pw groupshow %[1]s >/dev/null 2>&1 || pw groupadd -n %[1]s -g %[2]s\n"+
+					"pw usershow %[1]s >/dev/null 2>&1 || pw useradd -n %[1]s -u %[2]s -g %[1]s -d /nonexistent -s /sbin/nologin\n",
+				user, uid,
+			),
+		}
+	}
+
+	return
+}
+
+func (m pkgManifest) marshal() ([]byte, error) {
+	return marshalUCL(m)
+}
+
+// eachFile calls fn with each regular file in the tarball src, and where it
+// is installed.
+func (pi PkgInfo) eachFile(src string, fn func(name string, hdr *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zr, err := archives.Gz{}.OpenReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	bins := make(map[string]bool)
+	for _, bin := range pi.Binaries {
+		bins[path.Base(bin)] = true
+	}
+
+	tr := tar.NewReader(zr)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+
+		if bins[name] {
+			name = path.Join(pkgPrefix, "bin", name)
+		} else {
+			name = path.Join(pkgPrefix, "share", pi.Name, name)
+		}
+
+		if err := fn(name, hdr, tr); err != nil {
+			return err
+		}
+	}
+}
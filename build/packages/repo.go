@@ -0,0 +1,300 @@
+package packages
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/cynix/freebsd-binaries/build/utils"
+	"github.com/mholt/archives"
+)
+
+// pkgRepoMeta is the meta.conf of each repository, whose archives are in the
+// same format as the packages.
+const pkgRepoMeta = `version = 2;
+packing_format = "tzst";
+manifests = "packagesite.yaml";
+data = "data";
+manifests_archive = "packagesite";
+data_archive = "data";
+`
+
+// sha1DigestInfo is the DER prefix of a SHA-1 digest, with which pkg signs
+// and verifies the hex SHA-256 of the repository files.
+var sha1DigestInfo = []byte{0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14}
+
+// PkgRepo creates a pkg repository in Dir/<abi> for each of ABIs, signed with
+// Key if set.
+type PkgRepo struct {
+	Dir  string
+	ABIs []string
+	Key  *rsa.PrivateKey
+
+	// packages are the compact manifests of the packages added to each
+	// repository, with where they are in it.
+	packages map[string][]map[string]any
+}
+
+// Add copies the package read from r into All of the repository of its ABI.
+func (pr *PkgRepo) Add(core utils.Core, name string, r io.Reader) error {
+	f, err := os.CreateTemp(pr.Dir, ".*.pkg")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := sha256.New()
+
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return fmt.Errorf("could not download %q: %w", name, err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	m, err := readCompactManifest(f)
+	if err != nil {
+		return fmt.Errorf("could not read manifest of %q: %w", name, err)
+	}
+
+	abi, _ := m["abi"].(string)
+	pkgName, _ := m["name"].(string)
+	pkgVersion, _ := m["version"].(string)
+
+	if !slices.Contains(pr.ABIs, abi) {
+		core.Warning("Skipping %q for unknown ABI: %q", name, abi)
+		return nil
+	}
+
+	if pkgName == "" || pkgVersion == "" {
+		return fmt.Errorf("missing name or version in manifest of %q", name)
+	}
+
+	rel := fmt.Sprintf("All/%s-%s.pkg", pkgName, pkgVersion)
+	dst := filepath.Join(pr.Dir, abi, filepath.FromSlash(rel))
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), dst); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(dst, 0o644); err != nil {
+		return err
+	}
+
+	core.Info("Added %q as %s/%s", name, abi, rel)
+
+	m["path"], m["repopath"] = rel, rel
+	m["sum"] = hex.EncodeToString(h.Sum(nil))
+	m["pkgsize"] = size
+
+	if pr.packages == nil {
+		pr.packages = make(map[string][]map[string]any)
+	}
+
+	pr.packages[abi] = append(pr.packages[abi], m)
+	return nil
+}
+
+// Write creates the catalogue of each repository, including those that no
+// package was added to, and repo.pub in Dir if signing.
+func (pr *PkgRepo) Write(core utils.Core) error {
+	for _, abi := range pr.ABIs {
+		if err := core.Group("Creating repository "+abi, func() error {
+			return pr.write(abi)
+		}); err != nil {
+			return fmt.Errorf("could not create repository %q: %w", abi, err)
+		}
+	}
+
+	if pr.Key == nil {
+		return nil
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&pr.Key.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(pr.Dir, "repo.pub"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644)
+}
+
+func (pr *PkgRepo) write(abi string) error {
+	dir := filepath.Join(pr.Dir, abi)
+
+	if err := os.MkdirAll(filepath.Join(dir, "All"), 0o755); err != nil {
+		return err
+	}
+
+	pkgs := pr.packages[abi]
+	slices.SortFunc(pkgs, func(a, b map[string]any) int {
+		return strings.Compare(a["path"].(string), b["path"].(string))
+	})
+
+	var site bytes.Buffer
+	for _, m := range pkgs {
+		b, err := marshalUCL(m)
+		if err != nil {
+			return err
+		}
+
+		site.Write(b)
+	}
+
+	data, err := marshalUCL(map[string]any{"groups": []any{}, "packages": append([]map[string]any{}, pkgs...)})
+	if err != nil {
+		return err
+	}
+
+	if err := pr.archive(filepath.Join(dir, "packagesite.pkg"), "packagesite.yaml", site.Bytes()); err != nil {
+		return err
+	}
+
+	if err := pr.archive(filepath.Join(dir, "data.pkg"), "data", data); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, "meta.conf"), []byte(pkgRepoMeta), 0o644)
+}
+
+// archive writes b as name to the tar.zst dst, followed by its signature.
+func (pr *PkgRepo) archive(dst, name string, b []byte) error {
+	entries := []struct {
+		name string
+		b    []byte
+	}{{name, b}}
+
+	if pr.Key != nil {
+		sig, err := pr.sign(b)
+		if err != nil {
+			return fmt.Errorf("could not sign %q: %w", name, err)
+		}
+
+		entries = append(entries, struct {
+			name string
+			b    []byte
+		}{"signature", sig})
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw, err := archives.Zstd{}.OpenWriter(f)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(zw)
+
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.b)), Uname: "root", Gname: "wheel"}); err != nil {
+			return err
+		}
+
+		if _, err := tw.Write(e.b); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// sign returns the signature of b as pkg expects it: the hex SHA-256 of b,
+// with its terminating NUL, signed as if it were a SHA-1 digest, followed by
+// another NUL.
+func (pr *PkgRepo) sign(b []byte) ([]byte, error) {
+	sum := sha256.Sum256(b)
+	msg := append(slices.Clone(sha1DigestInfo), hex.EncodeToString(sum[:])+"\x00"...)
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, pr.Key, crypto.Hash(0), msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(sig, 0), nil
+}
+
+// readCompactManifest returns the +COMPACT_MANIFEST of the package read from
+// r, which comes first.
+func readCompactManifest(r io.Reader) (map[string]any, error) {
+	zr, err := archives.Zstd{}.OpenReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no +COMPACT_MANIFEST")
+		} else if err != nil {
+			return nil, err
+		}
+
+		if hdr.Name != "+COMPACT_MANIFEST" {
+			continue
+		}
+
+		var m map[string]any
+
+		dec := json.NewDecoder(tr)
+		dec.UseNumber()
+
+		if err := dec.Decode(&m); err != nil {
+			return nil, err
+		}
+
+		return m, nil
+	}
+}
+
+// marshalUCL returns v as a line of JSON, which pkg reads as UCL, keeping
+// scripts readable.
+func marshalUCL(v any) ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
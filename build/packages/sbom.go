@@ -0,0 +1,264 @@
+package packages
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"debug/buildinfo"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/cynix/freebsd-binaries/build/utils"
+)
+
+// cdxBOM is a CycloneDX SBOM. It has no serial number or timestamp, so that
+// rebuilds produce the same SBOM.
+type cdxBOM struct {
+	BOMFormat   string `json:"bomFormat"`
+	SpecVersion string `json:"specVersion"`
+	Version     int    `json:"version"`
+	Metadata    struct {
+		Component cdxComponent `json:"component"`
+	} `json:"metadata"`
+	Components []cdxComponent `json:"components"`
+}
+
+type cdxComponent struct {
+	Type       string        `json:"type"`
+	Name       string        `json:"name"`
+	Version    string        `json:"version,omitempty"`
+	PURL       string        `json:"purl,omitempty"`
+	Hashes     []cdxHash     `json:"hashes,omitempty"`
+	Properties []cdxProperty `json:"properties,omitempty"`
+}
+
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// WriteSBOMs creates dist/<name>.<binary>.cdx.json for each binary in
+// dist/<name>.tar.gz. The dependencies of Go binaries are read from their
+// build info, and those of Rust binaries from the Cargo.lock of cargo, the
+// Cargo.toml relative to src that they were built from, if set.
+func (pi PkgInfo) WriteSBOMs(core utils.Core, r utils.Runner, tarball, cargo string) error {
+	stem := strings.TrimSuffix(tarball, ".tar.gz")
+
+	for _, bin := range pi.Binaries {
+		sbom := fmt.Sprintf("%s.%s.cdx.json", stem, path.Base(bin))
+
+		if err := core.Group("Creating "+sbom, func() error {
+			return utils.Perform(r, utils.Step{Action: "sbom", Target: path.Join("dist", sbom), Detail: path.Join("dist", tarball)}, func() error {
+				return pi.writeSBOM(core, path.Join("dist", tarball), path.Join("dist", sbom), path.Base(bin), cargo)
+			})
+		}); err != nil {
+			return fmt.Errorf("could not create %q: %w", sbom, err)
+		}
+	}
+
+	return nil
+}
+
+func (pi PkgInfo) writeSBOM(core utils.Core, src, dst, bin, cargo string) error {
+	var b []byte
+
+	if err := pi.eachFile(src, func(name string, hdr *tar.Header, r io.Reader) error {
+		if name != path.Join(pkgPrefix, "bin", bin) {
+			return nil
+		}
+
+		var err error
+		b, err = io.ReadAll(r)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	if b == nil {
+		return fmt.Errorf("binary not found: %q", bin)
+	}
+
+	sum := sha256.Sum256(b)
+
+	bom := cdxBOM{BOMFormat: "CycloneDX", SpecVersion: "1.5", Version: 1, Components: []cdxComponent{}}
+	bom.Metadata.Component = cdxComponent{
+		Type:    "application",
+		Name:    bin,
+		Version: pi.Version,
+		Hashes:  []cdxHash{{"SHA-256", hex.EncodeToString(sum[:])}},
+	}
+
+	if bi, err := buildinfo.Read(bytes.NewReader(b)); err == nil {
+		bom.Metadata.Component.Properties = append(bom.Metadata.Component.Properties, cdxProperty{"go:version", bi.GoVersion})
+
+		for _, dep := range append([]*debug.Module{&bi.Main}, bi.Deps...) {
+			if dep.Replace != nil {
+				dep = dep.Replace
+			}
+
+			if dep.Path == "" {
+				continue
+			}
+
+			bom.Components = append(bom.Components, cdxComponent{
+				Type:    "library",
+				Name:    dep.Path,
+				Version: dep.Version,
+				PURL:    fmt.Sprintf("pkg:golang/%s@%s", dep.Path, dep.Version),
+			})
+		}
+	} else if cargo != "" {
+		deps, err := cargoDeps(cargo)
+		if err != nil {
+			return err
+		}
+
+		bom.Components = append(bom.Components, deps...)
+	}
+
+	core.Info("Listing %d dependencies of %q", len(bom.Components), bin)
+
+	out, err := json.MarshalIndent(bom, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(dst, append(out, '\n'), 0o644)
+}
+
+// cargoDeps returns the packages in the Cargo.lock next to or above the
+// Cargo.toml manifest in src.
+func cargoDeps(manifest string) ([]cdxComponent, error) {
+	dir := path.Dir(path.Clean(manifest))
+
+	for {
+		f, err := os.Open(filepath.Join("src", dir, "Cargo.lock"))
+		if err == nil {
+			defer f.Close()
+			return parseCargoLock(f)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if dir == "." {
+			return nil, fmt.Errorf("no Cargo.lock found for %q", manifest)
+		}
+
+		dir = path.Dir(dir)
+	}
+}
+
+// parseCargoLock reads the packages of a Cargo.lock, taking its TOML only as
+// far as cargo writes it.
+func parseCargoLock(r io.Reader) (deps []cdxComponent, err error) {
+	var dep *cdxComponent
+
+	sc := bufio.NewScanner(r)
+
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+
+		if strings.HasPrefix(line, "[") {
+			dep = nil
+
+			if line == "[[package]]" {
+				deps = append(deps, cdxComponent{Type: "library"})
+				dep = &deps[len(deps)-1]
+			}
+
+			continue
+		}
+
+		k, v, ok := strings.Cut(line, "=")
+		if dep == nil || !ok {
+			continue
+		}
+
+		v = strings.TrimSpace(v)
+		if !strings.HasPrefix(v, `"`) {
+			continue
+		}
+
+		if v, err = strconv.Unquote(v); err != nil {
+			return nil, fmt.Errorf("invalid Cargo.lock line %q: %w", line, err)
+		}
+
+		switch strings.TrimSpace(k) {
+		case "name":
+			dep.Name = v
+		case "version":
+			dep.Version = v
+		case "checksum":
+			dep.Hashes = []cdxHash{{"SHA-256", v}}
+		case "source":
+			dep.Properties = []cdxProperty{{"cargo:source", v}}
+		}
+	}
+
+	if err = sc.Err(); err != nil {
+		return
+	}
+
+	for i := range deps {
+		deps[i].PURL = fmt.Sprintf("pkg:cargo/%s@%s", deps[i].Name, deps[i].Version)
+	}
+
+	slices.SortFunc(deps, func(a, b cdxComponent) int {
+		return strings.Compare(a.PURL, b.PURL)
+	})
+
+	return
+}
+
+// writeChecksums creates dist/<prefix>SHA256SUMS, listing the other files in
+// dist whose names start with prefix.
+func writeChecksums(core utils.Core, r utils.Runner, prefix string) error {
+	sums := prefix + "SHA256SUMS"
+
+	if err := core.Group("Creating "+sums, func() error {
+		return utils.Perform(r, utils.Step{Action: "checksum", Target: path.Join("dist", sums), Detail: path.Join("dist", prefix+"*")}, func() error {
+			files, err := filepath.Glob(filepath.Join("dist", prefix+"*"))
+			if err != nil {
+				return err
+			}
+
+			var sb strings.Builder
+
+			for _, file := range files {
+				if filepath.Base(file) == sums {
+					continue
+				}
+
+				b, err := os.ReadFile(file)
+				if err != nil {
+					return err
+				}
+
+				sum := sha256.Sum256(b)
+				fmt.Fprintf(&sb, "%s  %s\n", hex.EncodeToString(sum[:]), filepath.Base(file))
+				core.Info("Adding %q", file)
+			}
+
+			return os.WriteFile(filepath.Join("dist", sums), []byte(sb.String()), 0o644)
+		})
+	}); err != nil {
+		return fmt.Errorf("could not create %q: %w", sums, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package packages
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/bobg/go-generics/v4/slices"
+	"github.com/cynix/freebsd-binaries/build/project"
+	"github.com/cynix/freebsd-binaries/build/schema"
+	"github.com/cynix/freebsd-binaries/build/utils"
+)
+
+// scriptPlaceholders are substituted in the commands, env and binaries of
+// script packages.
+var scriptPlaceholders = []string{"arch", "triple", "version"}
+
+type ScriptProject struct {
+	PackageProjectOf[ScriptPackage, ScriptConfig, *ScriptPackage] `yaml:",inline"`
+}
+
+// ScriptPackage is a package whose binaries are relative to the source, and
+// are archived by their base names.
+type ScriptPackage struct {
+	ScriptConfig `yaml:",inline"`
+	PackageBase  `yaml:",inline"`
+}
+
+type ScriptConfig struct {
+	// Commands are run by sh in the source, once for each arch.
+	Commands []string
+	Env      []string
+	Files    []string
+}
+
+func (sp *ScriptProject) JSONSchema(g *schema.Generator) *schema.Schema {
+	return sp.schema(g.Struct(sp), "script")
+}
+
+func (sp *ScriptPackage) Validate(v *project.Validator, at project.Path) {
+	bins := make(map[string]bool)
+
+	for i, bin := range sp.Binaries {
+		v.Placeholders(at.Key("binaries").Index(i), bin, scriptPlaceholders...)
+
+		if !filepath.IsLocal(bin) {
+			v.Errorf(at.Key("binaries").Index(i), "binary is not relative: %q", bin)
+		} else if bins[path.Base(bin)] {
+			v.Errorf(at.Key("binaries").Index(i), "duplicate binary: %q", path.Base(bin))
+		}
+
+		bins[path.Base(bin)] = true
+	}
+
+	if len(sp.Commands) == 0 {
+		v.Errorf(at, "no commands defined")
+	}
+
+	for i, cmd := range sp.Commands {
+		v.Placeholders(at.Key("commands").Index(i), cmd, scriptPlaceholders...)
+	}
+
+	for i, e := range sp.Env {
+		v.Placeholders(at.Key("env").Index(i), e, scriptPlaceholders...)
+
+		if k, _, ok := strings.Cut(e, "="); !ok || k == "" {
+			v.Errorf(at.Key("env").Index(i), "invalid env: %q", e)
+		}
+	}
+
+	for i, glob := range sp.Files {
+		if !doublestar.ValidatePattern(glob) {
+			v.Errorf(at.Key("files").Index(i), "invalid pattern: %q", glob)
+		}
+	}
+}
+
+func (*ScriptPackage) tarball() string {
+	return "{package}-v{version}-{triple}.tar.gz"
+}
+
+func (sp *ScriptPackage) JSONSchema(g *schema.Generator) *schema.Schema {
+	s := g.Struct(sp)
+	s.Properties["extends"] = project.ExtendsSchema()
+	return s
+}
+
+func (sp *ScriptPackage) Build(core utils.Core, r utils.Runner, pp *PackageProject, name, version string, pi PkgInfo) error {
+	for _, arch := range pp.Arch {
+		if err := sp.build(core, r, pp.Settings.Dockcross(), name, version, arch, pi); err != nil {
+			return err
+		}
+	}
+
+	return writeChecksums(core, r, fmt.Sprintf("%s-v%s-", name, version))
+}
+
+func (sp *ScriptPackage) build(core utils.Core, r utils.Runner, dockcross, name, version, arch string, pi PkgInfo) error {
+	a, err := project.LookupArch(arch)
+	if err != nil {
+		return err
+	}
+
+	triple := a.Triple
+	rep := strings.NewReplacer("{arch}", arch, "{triple}", triple, "{version}", version)
+	env := slices.Map(sp.Env, rep.Replace)
+	binaries := slices.Map(sp.Binaries, rep.Replace)
+
+	if err := core.Group(fmt.Sprintf("Building %s package", arch), func() error {
+		for _, cmd := range sp.Commands {
+			if err := utils.Command("/bin/sh", "-c", rep.Replace(cmd)).
+				In("src").
+				WithEnv(env...).
+				Via(&utils.Dockcross{Image: dockcross, Arch: arch, Runner: r}).
+				Run(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return fmt.Errorf("could not build %s package: %w", arch, err)
+	}
+
+	tarball := fmt.Sprintf("%s-v%s-%s.tar.gz", name, version, triple)
+	step := utils.Step{
+		Action: "archive",
+		Target: path.Join("dist", tarball),
+		Detail: strings.Join(append(slices.Map(binaries, func(bin string) string {
+			return path.Join("src", bin)
+		}), slices.Map(sp.Files, func(glob string) string {
+			return path.Join("src", glob)
+		})...), "\n"),
+	}
+
+	if err := core.Group("Creating "+tarball, func() error {
+		return utils.Perform(r, step, func() error { return archive(core, tarball, ".", binaries, sp.Files) })
+	}); err != nil {
+		return fmt.Errorf("could not create %q: %w", tarball, err)
+	}
+
+	pi.Binaries = binaries
+	if err := pi.Write(core, r, tarball, arch); err != nil {
+		return err
+	}
+
+	return pi.WriteSBOMs(core, r, tarball, "")
+}
+
+func (c *ScriptConfig) Hydrate(defaults ScriptConfig) {
+	if len(c.Commands) == 0 {
+		c.Commands = slices.Clone(defaults.Commands)
+	}
+
+	if len(c.Env) == 0 {
+		c.Env = slices.Clone(defaults.Env)
+	}
+
+	if len(c.Files) == 0 {
+		if c.Files = slices.Clone(defaults.Files); len(c.Files) == 0 {
+			c.Files = []string{"COPYING*", "LICENSE*"}
+		}
+	}
+}
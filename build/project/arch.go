@@ -0,0 +1,139 @@
+package project
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Arch is how the tools that build for a FreeBSD arch name it.
+type Arch struct {
+	// Name is how projects refer to the arch, which is also the {arch}
+	// placeholder.
+	Name string
+	// GoArch and GoArm are the GOARCH and GOARM of Go builds.
+	GoArch string
+	GoArm  string
+	// Triple is the Rust target, which is also the {triple} placeholder.
+	Triple string
+	// Target is the clang target.
+	Target string
+	// BuildStd builds the Rust standard library from source, for targets
+	// that rustup does not ship it for.
+	BuildStd bool
+	// Machine is the FreeBSD MACHINE_ARCH, as used in pkg ABIs.
+	Machine string
+	// PkgArch is the legacy arch of pkg manifests, following freebsd:<major>.
+	PkgArch string
+	// CPU is the CPU family of CMake and meson.
+	CPU string
+	// Sysroot is where the dockcross image has the FreeBSD base system of
+	// the arch, and the packages installed into it.
+	Sysroot string
+	// Platform is the OCI platform of container images.
+	Platform string
+}
+
+// Archs are the supported archs.
+var Archs = []Arch{
+	{
+		Name:     "amd64",
+		GoArch:   "amd64",
+		Triple:   "x86_64-unknown-freebsd",
+		Target:   "x86_64-unknown-freebsd",
+		Machine:  "amd64",
+		PkgArch:  "x86:64",
+		CPU:      "x86_64",
+		Sysroot:  "/freebsd/amd64",
+		Platform: "freebsd/amd64",
+	},
+	{
+		Name:     "arm64",
+		GoArch:   "arm64",
+		Triple:   "aarch64-unknown-freebsd",
+		Target:   "aarch64-unknown-freebsd",
+		BuildStd: true,
+		Machine:  "aarch64",
+		PkgArch:  "aarch64:64",
+		CPU:      "aarch64",
+		Sysroot:  "/freebsd/aarch64",
+		Platform: "freebsd/arm64",
+	},
+	{
+		Name:     "riscv64",
+		GoArch:   "riscv64",
+		Triple:   "riscv64gc-unknown-freebsd",
+		Target:   "riscv64-unknown-freebsd",
+		BuildStd: true,
+		Machine:  "riscv64",
+		PkgArch:  "riscv:64:hf",
+		CPU:      "riscv64",
+		Sysroot:  "/freebsd/riscv64",
+		Platform: "freebsd/riscv64",
+	},
+	{
+		Name:     "armv7",
+		GoArch:   "arm",
+		GoArm:    "7",
+		Triple:   "armv7-unknown-freebsd",
+		Target:   "armv7-unknown-freebsd-gnueabihf",
+		BuildStd: true,
+		Machine:  "armv7",
+		PkgArch:  "armv7:32:el:eabi:hardfp",
+		CPU:      "arm",
+		Sysroot:  "/freebsd/armv7",
+		Platform: "freebsd/arm/v7",
+	},
+	{
+		Name:     "i386",
+		GoArch:   "386",
+		Triple:   "i686-unknown-freebsd",
+		Target:   "i686-unknown-freebsd",
+		Machine:  "i386",
+		PkgArch:  "x86:32",
+		CPU:      "x86",
+		Sysroot:  "/freebsd/i386",
+		Platform: "freebsd/386",
+	},
+}
+
+var (
+	// SupportedArchs are the names of Archs.
+	SupportedArchs = archNames()
+	// DefaultArchs are built by projects that do not list their own.
+	DefaultArchs = []string{"amd64", "arm64"}
+)
+
+func archNames() (names []string) {
+	for _, a := range Archs {
+		names = append(names, a.Name)
+	}
+
+	return
+}
+
+// LookupArch returns the supported arch of the given name.
+func LookupArch(name string) (Arch, error) {
+	for _, a := range Archs {
+		if a.Name == name {
+			return a, nil
+		}
+	}
+
+	return Arch{}, fmt.Errorf("unsupported arch: %q", name)
+}
+
+// PkgABI returns the package ABI of a FreeBSD version, or just its major
+// version, and arch.
+func PkgABI(freebsd, arch string) (string, error) {
+	major, _, _ := strings.Cut(freebsd, ".")
+	if len(major) != 2 || strings.Trim(major, "0123456789") != "" {
+		return "", fmt.Errorf("invalid FreeBSD version: %q", freebsd)
+	}
+
+	a, err := LookupArch(arch)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("FreeBSD:%s:%s", major, a.Machine), nil
+}
@@ -0,0 +1,106 @@
+package project
+
+import (
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/cynix/freebsd-binaries/build/schema"
+)
+
+// Schedules are how often the containers of a project pick up updates of
+// their base image and FreeBSD packages. Changes of the project itself,
+// including new upstream versions, are always picked up.
+const (
+	// ScheduleOnChange picks up updates as soon as they are found, which is
+	// the default.
+	ScheduleOnChange = "on-change"
+	ScheduleDaily    = "daily"
+	ScheduleWeekly   = "weekly"
+	ScheduleMonthly  = "monthly"
+	// ScheduleOnRelease ignores updates until the next upstream release.
+	ScheduleOnRelease = "on-release"
+)
+
+// States are where a project is in its lifecycle.
+const (
+	// StateActive is built as usual, which is the default.
+	StateActive = "active"
+	// StateFrozen is only built when forced.
+	StateFrozen = "frozen"
+	// StateDeprecated is built as usual, with its note recorded in its
+	// images.
+	StateDeprecated = "deprecated"
+	// StateDisabled is never built.
+	StateDisabled = "disabled"
+)
+
+var labelRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+var (
+	Schedules = []string{ScheduleOnChange, ScheduleDaily, ScheduleWeekly, ScheduleMonthly, ScheduleOnRelease}
+	States    = []string{StateActive, StateFrozen, StateDeprecated, StateDisabled}
+)
+
+// Common returns the fields shared by all projects.
+func (bp *BaseProject) Common() *BaseProject {
+	return bp
+}
+
+// RefreshDue reports whether updates of the base image and packages are due
+// to be picked up, given when the published image was created.
+func (bp *BaseProject) RefreshDue(created time.Time) bool {
+	var interval time.Duration
+
+	switch bp.Schedule {
+	case "", ScheduleOnChange:
+		return true
+	case ScheduleOnRelease:
+		return false
+	case ScheduleDaily:
+		interval = 24 * time.Hour
+	case ScheduleWeekly:
+		interval = 7 * 24 * time.Hour
+	case ScheduleMonthly:
+		interval = 30 * 24 * time.Hour
+	}
+
+	return time.Since(created) >= interval
+}
+
+func (bp *BaseProject) Validate(v *Validator, at Path) {
+	v.Arch(at.Key("arch"), bp.Arch)
+
+	if bp.Schedule != "" && !slices.Contains(Schedules, bp.Schedule) {
+		v.Errorf(at.Key("schedule"), "unknown schedule: %q", bp.Schedule)
+	}
+
+	if bp.State != "" && !slices.Contains(States, bp.State) {
+		v.Errorf(at.Key("state"), "unknown state: %q", bp.State)
+	}
+
+	bp.Resources.Validate(v, at.Key("resources"))
+
+	for i, label := range bp.Labels {
+		if !labelRegex.MatchString(label) {
+			v.Errorf(at.Key("labels").Index(i), "invalid label: %q", label)
+		} else if slices.Index(bp.Labels, label) < i {
+			v.Errorf(at.Key("labels").Index(i), "duplicate label: %q", label)
+		}
+	}
+}
+
+// ScheduleSchema and StateSchema describe the lifecycle fields shared by all
+// projects.
+func ScheduleSchema() *schema.Schema {
+	return &schema.Schema{Type: "string", Enum: Schedules}
+}
+
+func StateSchema() *schema.Schema {
+	return &schema.Schema{Type: "string", Enum: States}
+}
+
+// LabelsSchema describes the labels shared by all projects.
+func LabelsSchema() *schema.Schema {
+	return schema.Array(&schema.Schema{Type: "string", Pattern: labelRegex.String()})
+}
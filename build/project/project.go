@@ -1,7 +1,13 @@
 package project
 
 import (
+	"regexp"
+	"time"
+
+	"github.com/cynix/freebsd-binaries/build/registry"
+	"github.com/cynix/freebsd-binaries/build/schema"
 	"github.com/cynix/freebsd-binaries/build/utils"
+	"github.com/cynix/freebsd-binaries/build/version"
 	"github.com/google/go-github/v74/github"
 )
 
@@ -19,14 +25,103 @@ type ProjectJob struct {
 	Containers []string     `json:"containers"`
 }
 
+// Upstream describes the latest version available from upstream.
+type Upstream struct {
+	Version string
+	Date    time.Time
+
+	// Commits counts the commits made since a pinned commit, in which case
+	// Date is when the oldest of them was made.
+	Commits int
+}
+
+// Resolution describes what a build would fetch, as resolved from upstream.
+type Resolution struct {
+	Ref     string          `json:"ref,omitempty"`
+	Version string          `json:"version,omitempty"`
+	Assets  []ResolvedAsset `json:"assets,omitempty"`
+}
+
+// ResolvedAsset is a container asset as it would be deployed for one arch.
+// Versions of FreeBSD packages are not known without a base image, so only
+// their names are given.
+type ResolvedAsset struct {
+	Container string   `json:"container"`
+	Arch      string   `json:"arch"`
+	Version   string   `json:"version,omitempty"`
+	Ref       string   `json:"ref,omitempty"`
+	URL       string   `json:"url,omitempty"`
+	Pkgs      []string `json:"pkgs,omitempty"`
+}
+
+// Requirement is something that a container is built from which may itself
+// be built by some project: a release of a GitHub repo, or an image.
+type Requirement struct {
+	Repo string
+	// Tag is the tag of the release, which may contain placeholders, or
+	// empty if the release is found by Regex or is the latest one.
+	Tag   string
+	Regex *regexp.Regexp
+
+	Image string
+}
+
 type Project interface {
-	Hydrate(name string)
+	Hydrate(name string, s Settings)
 	Job(gh *github.Client) (ProjectJob, error)
-	BuildPackage(core utils.Core, gh *github.Client, version, name string) error
-	BuildContainer(core utils.Core, gh *github.Client, version, name string) error
+	Upstream(gh *github.Client) (Upstream, error)
+	Resolve(gh *github.Client) (Resolution, error)
+	BuildPackage(core utils.Core, gh *github.Client, r utils.Runner, version, name string) error
+	BuildContainer(core utils.Core, gh *github.Client, r utils.Runner, version, name string) error
+	Fingerprint() (string, error)
+	RebuildReason(gh *github.Client, reg *registry.Client, version, name string) string
+	Containers() []string
+	Requires() []Requirement
+	Sources() []version.RepoRef
+	Common() *BaseProject
+	Validate(v *Validator, at Path)
 }
 
 type BaseProject struct {
-	Name string
-	Arch []string
+	Name     string   `yaml:"-"`
+	Settings Settings `yaml:"-"`
+	Arch     []string
+	// Labels group projects for selection, e.g. label=media.
+	Labels    []string
+	Resources Resources
+	Schedule  string
+	State     string
+	// Note explains the state of the project, and is logged whenever it is
+	// not active.
+	Note string
+}
+
+// ExtendsSchema describes the templates or projects that a project or
+// package extends.
+func ExtendsSchema() *schema.Schema {
+	return schema.OneOf(schema.String(), schema.Array(schema.String()))
+}
+
+// ArchSchema describes the arch list shared by all projects.
+func ArchSchema() *schema.Schema {
+	return schema.Array(&schema.Schema{Type: "string", Enum: SupportedArchs})
+}
+
+// BaseSchema completes the schema of a project with the fields shared by all
+// projects.
+func BaseSchema(s *schema.Schema) *schema.Schema {
+	s.Properties["arch"] = ArchSchema()
+	s.Properties["labels"] = LabelsSchema()
+	s.Properties["schedule"] = ScheduleSchema()
+	s.Properties["state"] = StateSchema()
+	s.Properties["extends"] = ExtendsSchema()
+	return s
+}
+
+// RequireSchema makes fields required in the schema of a project, unless it
+// extends others, which may provide them instead.
+func RequireSchema(s *schema.Schema, fields ...string) *schema.Schema {
+	s.If = &schema.Schema{Required: []string{"extends"}}
+	s.Else = &schema.Schema{Required: fields}
+	return s
 }
@@ -0,0 +1,53 @@
+package project
+
+import "github.com/cynix/freebsd-binaries/build/schema"
+
+// DefaultRunner and DefaultTimeout are the runner label and timeout, in
+// minutes, of builds that do not set their own.
+const (
+	DefaultRunner  = "ubuntu-latest"
+	DefaultTimeout = 360
+)
+
+// Resources are what the runners building a project need, as passed on to
+// the workflows through the matrix.
+type Resources struct {
+	// Runner is the label of the runners to build on.
+	Runner string `json:"runner"`
+	// Timeout is how many minutes each build may take.
+	Timeout int `json:"timeout"`
+	// Cleanup frees disk space on the runners before building.
+	Cleanup bool `json:"cleanup"`
+	// MaxArchs is how many archs of each package are built at once, or 0 to
+	// build one at a time, except with goreleaser, which then uses its own
+	// default. Packages built in the source tree, by script or by C projects
+	// with plain make, and container images are always built one arch at a
+	// time.
+	MaxArchs int `json:"max-archs"`
+}
+
+func (r *Resources) JSONSchema(g *schema.Generator) *schema.Schema {
+	s := g.Struct(r)
+	s.Properties["max-archs"].Description = "How many archs of each package are built at once, or 0 to build one at a time"
+	return s
+}
+
+func (r *Resources) Hydrate() {
+	if r.Runner == "" {
+		r.Runner = DefaultRunner
+	}
+
+	if r.Timeout == 0 {
+		r.Timeout = DefaultTimeout
+	}
+}
+
+func (r *Resources) Validate(v *Validator, at Path) {
+	if r.Timeout < 0 {
+		v.Errorf(at.Key("timeout"), "invalid timeout: %d", r.Timeout)
+	}
+
+	if r.MaxArchs < 0 {
+		v.Errorf(at.Key("max-archs"), "invalid max-archs: %d", r.MaxArchs)
+	}
+}
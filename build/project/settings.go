@@ -0,0 +1,156 @@
+package project
+
+import (
+	"cmp"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/cynix/freebsd-binaries/build/schema"
+)
+
+// Settings tell where packages are released and images are published, so that
+// a fork can build under its own name.
+type Settings struct {
+	// Release is the GitHub repo that packages are released in, as
+	// owner/repo.
+	Release string
+	// Registry is where images are pushed, as host/namespace.
+	Registry string
+	// Base is where base and toolchain images are pulled from, as
+	// host/namespace.
+	Base string
+	// FreeBSD is the major version of FreeBSD that pkg packages are built
+	// for.
+	FreeBSD string
+	GitHub  GitHubSettings
+}
+
+type GitHubSettings struct {
+	// Server is the URL of the GitHub server, which releases are downloaded
+	// from.
+	Server string
+	// API is the base URL of the GitHub API.
+	API string
+}
+
+// Hydrate fills in the defaults, which fall back to the GitHub server that a
+// workflow runs on.
+func (s *Settings) Hydrate() {
+	s.Release = cmp.Or(s.Release, "cynix/freebsd-binaries")
+	s.Registry = strings.TrimSuffix(cmp.Or(s.Registry, "ghcr.io/cynix"), "/")
+	s.Base = strings.TrimSuffix(cmp.Or(s.Base, s.Registry), "/")
+	s.FreeBSD = cmp.Or(s.FreeBSD, "14")
+	s.GitHub.Server = strings.TrimSuffix(cmp.Or(s.GitHub.Server, os.Getenv("GITHUB_SERVER_URL"), "https://github.com"), "/")
+
+	if s.GitHub.API == "" {
+		if s.GitHub.API = os.Getenv("GITHUB_API_URL"); s.GitHub.API == "" {
+			if s.GitHub.Server == "https://github.com" {
+				s.GitHub.API = "https://api.github.com"
+			} else {
+				s.GitHub.API = s.GitHub.Server + "/api/v3"
+			}
+		}
+	}
+
+	s.GitHub.API = strings.TrimSuffix(s.GitHub.API, "/") + "/"
+}
+
+// Owner returns the owner of the release repo.
+func (s Settings) Owner() string {
+	owner, _, _ := strings.Cut(s.Release, "/")
+	return owner
+}
+
+// Repo returns the name of the release repo.
+func (s Settings) Repo() string {
+	_, repo, _ := strings.Cut(s.Release, "/")
+	return repo
+}
+
+// ReleaseURL returns the URL that assets of the release tagged tag are
+// downloaded from.
+func (s Settings) ReleaseURL(tag string) string {
+	return s.GitHub.Server + "/" + s.Release + "/releases/download/" + tag
+}
+
+// RegistryHost returns the host of the registry that images are pushed to.
+func (s Settings) RegistryHost() string {
+	host, _, _ := strings.Cut(s.Registry, "/")
+	return host
+}
+
+// Repository returns the repository of image name within RegistryHost.
+func (s Settings) Repository(name string) string {
+	_, ns, _ := strings.Cut(s.Registry, "/")
+	return ns + "/" + name
+}
+
+// Image returns the reference of image name tagged tag.
+func (s Settings) Image(name, tag string) string {
+	return s.Registry + "/" + name + ":" + tag
+}
+
+// BaseImage returns the reference of base image name, which may carry a tag.
+func (s Settings) BaseImage(name string) string {
+	return s.Base + "/" + name
+}
+
+// Dockcross returns the reference of the dockcross image that packages are
+// cross-compiled in.
+func (s Settings) Dockcross() string {
+	return s.BaseImage("dockcross-freebsd:latest")
+}
+
+func (s Settings) Validate(v *Validator, at Path) {
+	if owner, repo, ok := strings.Cut(s.Release, "/"); !ok || owner == "" || repo == "" || strings.Contains(repo, "/") {
+		v.Errorf(at.Key("release"), "invalid repo: %q", s.Release)
+	}
+
+	if host, ns, ok := strings.Cut(s.Registry, "/"); !ok || host == "" || ns == "" {
+		v.Errorf(at.Key("registry"), "invalid registry namespace: %q", s.Registry)
+	}
+
+	if host, ns, ok := strings.Cut(s.Base, "/"); !ok || host == "" || ns == "" {
+		v.Errorf(at.Key("base"), "invalid registry namespace: %q", s.Base)
+	}
+
+	if !freebsdRegex.MatchString(s.FreeBSD) {
+		v.Errorf(at.Key("freebsd"), "invalid FreeBSD major version: %q", s.FreeBSD)
+	}
+
+	validateURL(v, at.Key("github").Key("server"), s.GitHub.Server)
+	validateURL(v, at.Key("github").Key("api"), s.GitHub.API)
+}
+
+func validateURL(v *Validator, at Path, s string) {
+	if u, err := url.Parse(s); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		v.Errorf(at, "invalid URL: %q", s)
+	}
+}
+
+func (s *Settings) JSONSchema(g *schema.Generator) *schema.Schema {
+	return &schema.Schema{
+		Type: "object",
+		Properties: map[string]*schema.Schema{
+			"release":  {Type: "string", Pattern: "^[^/]+/[^/]+$", Description: "GitHub repo that packages are released in, as owner/repo"},
+			"registry": {Type: "string", Pattern: namespacePattern, Description: "Registry namespace that images are pushed to, as host/namespace"},
+			"base":     {Type: "string", Pattern: namespacePattern, Description: "Registry namespace that base and toolchain images are pulled from, defaulting to registry"},
+			"freebsd":  {Type: "string", Pattern: freebsdRegex.String(), Description: "Major version of FreeBSD that pkg packages are built for"},
+			"github": {
+				Type: "object",
+				Properties: map[string]*schema.Schema{
+					"server": {Type: "string", Description: "URL of the GitHub server, for GitHub Enterprise"},
+					"api":    {Type: "string", Description: "Base URL of the GitHub API, defaulting to /api/v3 on the server for GitHub Enterprise"},
+				},
+				AdditionalProperties: false,
+			},
+		},
+		AdditionalProperties: false,
+	}
+}
+
+const namespacePattern = "^[^/]+/.+$"
+
+var freebsdRegex = regexp.MustCompile(`^[0-9]{2}$`)
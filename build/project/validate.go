@@ -0,0 +1,132 @@
+package project
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type Path []string
+
+type Problem struct {
+	Path    Path
+	Message string
+}
+
+type Validator struct {
+	Problems []Problem
+
+	// Roots and Patched record the names whose <name>/root overlay and
+	// <name>/*.patch files are used by some project.
+	Roots   map[string]struct{}
+	Patched map[string]struct{}
+
+	users []user
+}
+
+type user struct {
+	path Path
+	name string
+	uid  string
+}
+
+func (p Path) Key(key string) Path {
+	return append(slices.Clip(p), key)
+}
+
+func (p Path) Index(i int) Path {
+	return append(slices.Clip(p), "["+strconv.Itoa(i)+"]")
+}
+
+func (p Path) String() string {
+	var sb strings.Builder
+
+	for i, s := range p {
+		if i > 0 && !strings.HasPrefix(s, "[") {
+			sb.WriteByte('.')
+		}
+		sb.WriteString(s)
+	}
+
+	return sb.String()
+}
+
+func (v *Validator) Errorf(at Path, format string, args ...any) {
+	v.Problems = append(v.Problems, Problem{Path: at, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *Validator) Placeholders(at Path, s string, allowed ...string) {
+	for _, m := range placeholderRegex.FindAllString(s, -1) {
+		if !slices.Contains(allowed, strings.Trim(m, "{}")) {
+			v.Errorf(at, "unknown placeholder %s in %q", m, s)
+		}
+	}
+}
+
+func (v *Validator) Arch(at Path, archs []string) {
+	for i, arch := range archs {
+		if !slices.Contains(SupportedArchs, arch) {
+			v.Errorf(at.Index(i), "unsupported arch: %q", arch)
+		}
+	}
+}
+
+func (v *Validator) User(at Path, s string) {
+	name, uid, ok := strings.Cut(s, "=")
+
+	if name == "" && (ok || s != "") {
+		v.Errorf(at, "missing user name: %q", s)
+		return
+	}
+
+	if !ok {
+		return
+	}
+
+	if n, err := strconv.ParseUint(uid, 10, 32); err != nil || n == 0 {
+		v.Errorf(at, "invalid uid for user %q: %q", name, uid)
+		return
+	}
+
+	v.users = append(v.users, user{path: at, name: name, uid: uid})
+}
+
+func (v *Validator) Root(name string) {
+	if v.Roots == nil {
+		v.Roots = make(map[string]struct{})
+	}
+	v.Roots[name] = struct{}{}
+}
+
+func (v *Validator) Patch(name string) {
+	if v.Patched == nil {
+		v.Patched = make(map[string]struct{})
+	}
+	v.Patched[name] = struct{}{}
+}
+
+// CheckUsers reports users that are given conflicting uids, or uids that are
+// shared by different users, across projects.
+func (v *Validator) CheckUsers() {
+	for i, a := range v.users {
+		for _, b := range v.users[:i] {
+			if a.path[0] == b.path[0] {
+				continue
+			}
+
+			if a.uid == b.uid && a.name != b.name {
+				v.Errorf(a.path, "uid %s of user %q is already used by user %q at %s", a.uid, a.name, b.name, b.path)
+			} else if a.name == b.name && a.uid != b.uid {
+				v.Errorf(a.path, "user %q has uid %s but is given uid %s at %s", a.name, a.uid, b.uid, b.path)
+			} else if a.uid == b.uid {
+				v.Errorf(a.path, "uid %s of user %q is also used at %s", a.uid, a.name, b.path)
+			}
+		}
+	}
+}
+
+var (
+	placeholderRegex = regexp.MustCompile(`\{[a-z_]+\}`)
+)
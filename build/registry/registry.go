@@ -0,0 +1,264 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/cynix/freebsd-binaries/build/utils"
+)
+
+// Manifest media types accepted when resolving digests.
+var manifestTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// Client is a minimal OCI distribution client which authenticates
+// anonymously, enough to inspect public images.
+type Client struct {
+	Host string
+	HTTP *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+// HTTPClient is the default client of registries.
+var HTTPClient = http.DefaultClient
+
+func New(host string) *Client {
+	return &Client{Host: host, HTTP: HTTPClient}
+}
+
+// Tags lists all tags of repo, e.g. "cynix/caddy".
+func (c *Client) Tags(repo string) (tags []string, err error) {
+	next := fmt.Sprintf("https://%s/v2/%s/tags/list?n=1000", c.Host, repo)
+
+	for next != "" {
+		var resp *http.Response
+		if resp, err = c.get(repo, http.MethodGet, next, nil); err != nil {
+			return
+		}
+
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+
+		if err != nil {
+			err = fmt.Errorf("could not decode tags of %q: %w", repo, err)
+			return
+		}
+
+		tags = append(tags, list.Tags...)
+
+		if next, err = nextLink(next, resp.Header.Get("Link")); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Digest returns the digest of the manifest of repo:ref.
+func (c *Client) Digest(repo, ref string) (string, error) {
+	resp, err := c.get(repo, http.MethodHead, fmt.Sprintf("https://%s/v2/%s/manifests/%s", c.Host, repo, ref), manifestTypes)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("no digest for %s:%s", repo, ref)
+	}
+
+	return digest, nil
+}
+
+// Manifest decodes the manifest of repo:ref into v.
+func (c *Client) Manifest(repo, ref string, v any) error {
+	resp, err := c.get(repo, http.MethodGet, fmt.Sprintf("https://%s/v2/%s/manifests/%s", c.Host, repo, ref), manifestTypes)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("could not decode manifest of %s:%s: %w", repo, ref, err)
+	}
+
+	return nil
+}
+
+// Annotations returns the annotations of the image repo:ref. For an image
+// index, those of its first image are included, since builds annotate each
+// image rather than the index.
+func (c *Client) Annotations(repo, ref string) (map[string]string, error) {
+	var m struct {
+		Manifests []struct {
+			Digest string `json:"digest"`
+		} `json:"manifests"`
+		Annotations map[string]string `json:"annotations"`
+	}
+
+	if err := c.Manifest(repo, ref, &m); err != nil {
+		return nil, err
+	}
+
+	if len(m.Manifests) > 0 {
+		digest := m.Manifests[0].Digest
+		m.Manifests = nil
+
+		if err := c.Manifest(repo, digest, &m); err != nil {
+			return nil, err
+		}
+	}
+
+	return m.Annotations, nil
+}
+
+func (c *Client) get(repo, method, u string, accept []string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, u, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(accept) > 0 {
+			req.Header.Set("Accept", strings.Join(accept, ", "))
+		}
+
+		c.mu.Lock()
+		token := c.tokens[repo]
+		c.mu.Unlock()
+
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := c.HTTP.Do(utils.Anonymous(req))
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+
+			if err := c.authenticate(repo, challenge); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if resp.StatusCode >= 400 {
+			resp.Body.Close()
+			return nil, fmt.Errorf("could not %s %q: %v", method, u, resp.Status)
+		}
+
+		return resp, nil
+	}
+}
+
+// authenticate obtains an anonymous pull token as directed by a Bearer
+// challenge.
+func (c *Client) authenticate(repo, challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("unsupported auth challenge for %q: %q", repo, challenge)
+	}
+
+	q := url.Values{}
+	var realm string
+
+	for param := range strings.SplitSeq(params, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			continue
+		}
+
+		v = strings.Trim(v, `"`)
+
+		switch k {
+		case "realm":
+			realm = v
+		case "service", "scope":
+			q.Set(k, v)
+		}
+	}
+
+	if realm == "" {
+		return fmt.Errorf("no realm in auth challenge for %q: %q", repo, challenge)
+	}
+
+	if q.Get("scope") == "" {
+		q.Set("scope", fmt.Sprintf("repository:%s:pull", repo))
+	}
+
+	resp, err := c.HTTP.Get(realm + "?" + q.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("could not get token for %q: %v", repo, resp.Status)
+	}
+
+	var tok struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok); err != nil {
+		return fmt.Errorf("could not decode token for %q: %w", repo, err)
+	}
+
+	if tok.Token == "" {
+		tok.Token = tok.AccessToken
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tokens == nil {
+		c.tokens = make(map[string]string)
+	}
+	c.tokens[repo] = tok.Token
+
+	return nil
+}
+
+func nextLink(base, link string) (string, error) {
+	for l := range strings.SplitSeq(link, ",") {
+		target, params, _ := strings.Cut(strings.TrimSpace(l), ";")
+		if !strings.Contains(params, `rel="next"`) {
+			continue
+		}
+
+		b, err := url.Parse(base)
+		if err != nil {
+			return "", err
+		}
+
+		u, err := b.Parse(strings.Trim(target, "<>"))
+		if err != nil {
+			return "", err
+		}
+
+		return u.String(), nil
+	}
+
+	return "", nil
+}
@@ -0,0 +1,195 @@
+package schema
+
+import (
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+const Draft = "http://json-schema.org/draft-07/schema#"
+
+type Schema struct {
+	Schema      string `json:"$schema,omitempty"`
+	Ref         string `json:"$ref,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	Type    string   `json:"type,omitempty"`
+	Const   any      `json:"const,omitempty"`
+	Enum    []string `json:"enum,omitempty"`
+	Pattern string   `json:"pattern,omitempty"`
+
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	PatternProperties    map[string]*Schema `json:"patternProperties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties any                `json:"additionalProperties,omitempty"`
+
+	Items *Schema   `json:"items,omitempty"`
+	OneOf []*Schema `json:"oneOf,omitempty"`
+	AnyOf []*Schema `json:"anyOf,omitempty"`
+
+	If   *Schema `json:"if,omitempty"`
+	Then *Schema `json:"then,omitempty"`
+	Else *Schema `json:"else,omitempty"`
+
+	Definitions map[string]*Schema `json:"definitions,omitempty"`
+}
+
+// Schemer is implemented by types whose YAML form differs from their Go
+// fields, typically because they have a custom UnmarshalYAML.
+type Schemer interface {
+	JSONSchema(g *Generator) *Schema
+}
+
+// Generator derives schemas from Go types the same way go-yaml decodes
+// them, collecting named types into definitions.
+type Generator struct {
+	defs map[string]*Schema
+}
+
+var schemerType = reflect.TypeFor[Schemer]()
+
+// Generate returns a complete schema document for v.
+func Generate(v any) *Schema {
+	g := &Generator{defs: make(map[string]*Schema)}
+
+	s := g.build(reflect.TypeOf(v))
+	s.Schema = Draft
+	s.Definitions = g.defs
+
+	return s
+}
+
+// Reflect returns the schema of v, as a reference if v is a named type.
+func (g *Generator) Reflect(v any) *Schema {
+	return g.typ(reflect.TypeOf(v))
+}
+
+// Struct returns the schema of the fields of struct v, ignoring any
+// JSONSchema method of v itself.
+func (g *Generator) Struct(v any) *Schema {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	s := &Schema{Type: "object", Properties: make(map[string]*Schema), AdditionalProperties: false}
+	g.fields(s, t)
+
+	return s
+}
+
+func String() *Schema {
+	return &Schema{Type: "string"}
+}
+
+func Array(items *Schema) *Schema {
+	return &Schema{Type: "array", Items: items}
+}
+
+func OneOf(s ...*Schema) *Schema {
+	return &Schema{OneOf: s}
+}
+
+func AnyOf(s ...*Schema) *Schema {
+	return &Schema{AnyOf: s}
+}
+
+func (g *Generator) typ(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t.Name() == "" || t.PkgPath() == "" {
+		return g.build(t)
+	}
+
+	name := path.Base(t.PkgPath()) + "." + t.Name()
+
+	if _, ok := g.defs[name]; !ok {
+		// Reserve the name first in case the type is recursive.
+		g.defs[name] = nil
+		g.defs[name] = g.build(t)
+	}
+
+	return &Schema{Ref: "#/definitions/" + name}
+}
+
+func (g *Generator) build(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if reflect.PointerTo(t).Implements(schemerType) {
+		return reflect.New(t).Interface().(Schemer).JSONSchema(g)
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return String()
+
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+
+	case reflect.Slice, reflect.Array:
+		return Array(g.typ(t.Elem()))
+
+	case reflect.Map:
+		if t.Elem().Kind() == reflect.String {
+			// Values such as env vars are commonly written as bare numbers,
+			// which go-yaml happily decodes into strings.
+			return &Schema{Type: "object", AdditionalProperties: OneOf(String(), &Schema{Type: "number"}, &Schema{Type: "boolean"})}
+		}
+
+		return &Schema{Type: "object", AdditionalProperties: g.typ(t.Elem())}
+
+	case reflect.Struct:
+		return g.Struct(reflect.New(t).Interface())
+	}
+
+	return &Schema{}
+}
+
+func (g *Generator) fields(s *Schema, t reflect.Type) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+
+		if !f.IsExported() && !f.Anonymous {
+			continue
+		}
+
+		tag := f.Tag.Get("yaml")
+		if tag == "" {
+			tag = f.Tag.Get("json")
+		}
+
+		if tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+
+		if slices.Contains(strings.Split(opts, ","), "inline") {
+			ft := f.Type
+			for ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+
+			g.fields(s, ft)
+			continue
+		}
+
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+
+		s.Properties[name] = g.typ(f.Type)
+	}
+}
@@ -9,7 +9,11 @@ import (
 )
 
 type Dockcross struct {
-	Arch string
+	Image string
+	Arch  string
+
+	// Runner runs the resulting docker command, if set.
+	Runner Runner
 }
 
 func (dx *Dockcross) Command(name string, args ...string) *Cmd {
@@ -17,7 +21,7 @@ func (dx *Dockcross) Command(name string, args ...string) *Cmd {
 }
 
 func (dx *Dockcross) Run(cmd *exec.Cmd) (err error) {
-	if cmd.Path, err = exec.LookPath("docker"); err != nil {
+	if cmd.Path, err = exec.LookPath("docker"); err != nil && dx.Runner == nil {
 		return err
 	}
 
@@ -59,10 +63,14 @@ func (dx *Dockcross) Run(cmd *exec.Cmd) (err error) {
 		args = append(args, "--env=FREEBSD_ARCH="+dx.Arch)
 	}
 
-	args = append(args, "ghcr.io/cynix/dockcross-freebsd:latest")
+	args = append(args, dx.Image)
 	cmd.Args = append(args, cmd.Args...)
 	cmd.Env = nil
 
+	if dx.Runner != nil {
+		return dx.Runner.Run(cmd)
+	}
+
 	fmt.Fprintf(os.Stderr, "::debug::[DX] %q\n", cmd.Args)
 
 	return cmd.Run()
@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// maxCachedBody is the largest response body that HTTPCache stores, so that
+// downloads pass through without filling the disk.
+const maxCachedBody = 8 << 20
+
+// HTTPCache is a transport that keeps successful GET responses on disk. Fresh
+// responses, i.e. stored less than TTL ago, are served as is, while stale
+// ones are revalidated through their ETag or Last-Modified.
+type HTTPCache struct {
+	Dir string
+	TTL time.Duration
+
+	// Offline serves every request from the cache regardless of age, and
+	// fails those that are not cached.
+	Offline bool
+
+	Transport http.RoundTripper
+}
+
+func (hc *HTTPCache) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := hc.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	if req.Method != http.MethodGet {
+		if hc.Offline {
+			return nil, fmt.Errorf("cannot %s %s while offline", req.Method, req.URL)
+		}
+
+		return transport.RoundTrip(req)
+	}
+
+	// Unreadable entries are as good as missing, and are replaced.
+	name := hc.path(req)
+	cached, stored, _ := hc.load(name, req)
+
+	switch {
+	case cached != nil && (hc.Offline || time.Since(stored) < hc.TTL):
+		return cached, nil
+
+	case hc.Offline:
+		return nil, fmt.Errorf("%s is not cached while offline", req.URL)
+	}
+
+	if cached != nil {
+		req = req.Clone(req.Context())
+
+		if etag := cached.Header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+
+		if modified := cached.Header.Get("Last-Modified"); modified != "" {
+			req.Header.Set("If-Modified-Since", modified)
+		}
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		resp.Body.Close()
+
+		now := time.Now()
+		os.Chtimes(name, now, now)
+
+		return cached, nil
+	}
+
+	if cached != nil {
+		cached.Body.Close()
+	}
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Cache-Control") == "no-store" {
+		return resp, nil
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxCachedBody+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	if len(b) > maxCachedBody {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+
+		return resp, nil
+	}
+
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	resp.ContentLength = int64(len(b))
+	resp.TransferEncoding = nil
+
+	// Failing to cache the response does not fail the request.
+	hc.store(name, resp, b)
+
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	return resp, nil
+}
+
+// path returns the file that the response to req is cached in. Responses vary
+// by the representation asked for, and by the credentials they were asked
+// for with, so that they are never served to anyone else, unless those are
+// anonymous.
+func (hc *HTTPCache) path(req *http.Request) string {
+	var auth string
+	if anonymous, _ := req.Context().Value(anonymousKey{}).(bool); !anonymous {
+		auth = req.Header.Get("Authorization")
+	}
+
+	h := sha256.Sum256([]byte(req.URL.String() + "\x00" + req.Header.Get("Accept") + "\x00" + auth))
+	return filepath.Join(hc.Dir, hex.EncodeToString(h[:]))
+}
+
+type anonymousKey struct{}
+
+// Anonymous marks the credentials of req as anonymous, such as a pull token
+// that anyone can obtain, which HTTPCache leaves out of its keys, as they
+// change with every token without telling anything about who asked.
+func Anonymous(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), anonymousKey{}, true))
+}
+
+func (hc *HTTPCache) load(name string, req *http.Request) (*http.Response, time.Time, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(f), req)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	return resp, fi.ModTime(), nil
+}
+
+func (hc *HTTPCache) store(name string, resp *http.Response, body []byte) error {
+	if err := os.MkdirAll(hc.Dir, 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(hc.Dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	if err := resp.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"errors"
+	"sync"
+)
+
+// Parallel calls fn for each of items, running up to n at once, and returns
+// the errors of all of them. Items are handled one at a time, in order, if n
+// is less than 2 or r records a plan, whose steps must stay in order.
+//
+// Concurrent calls are given a core that prints groups flat, as they would
+// otherwise interleave.
+func Parallel[T any](core Core, r Runner, n int, items []T, fn func(Core, T) error) error {
+	if _, ok := r.(*Recorder); ok || n < 2 || len(items) < 2 {
+		for _, item := range items {
+			if err := fn(core, item); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	core = Flat(core)
+	errs := make([]error, len(items))
+
+	var (
+		wg      sync.WaitGroup
+		workers = make(chan struct{}, n)
+	)
+
+	for i, item := range items {
+		wg.Go(func() {
+			workers <- struct{}{}
+			defer func() { <-workers }()
+
+			errs[i] = fn(core, item)
+		})
+	}
+
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Flat returns core with groups printed as plain lines, for goroutines whose
+// groups would otherwise interleave with those of others.
+func Flat(core Core) Core {
+	if _, ok := core.(flatCore); ok {
+		return core
+	}
+
+	return flatCore{core}
+}
+
+type flatCore struct {
+	Core
+}
+
+func (fc flatCore) Group(name string, fn func() error) error {
+	fc.Info("%s", name)
+	return fn()
+}
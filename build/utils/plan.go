@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+type Step struct {
+	Group  string   `json:"group,omitempty"`
+	Action string   `json:"action"`
+	Args   []string `json:"args,omitempty"`
+	Dir    string   `json:"dir,omitempty"`
+	Env    []string `json:"env,omitempty"`
+	Input  string   `json:"input,omitempty"`
+	Target string   `json:"target,omitempty"`
+	Detail string   `json:"detail,omitempty"`
+}
+
+// Recorder is a Runner that records commands instead of running them, so
+// that a build can be planned without side effects.
+type Recorder struct {
+	Steps []Step
+
+	// Output returns the simulated stdout of a command.
+	Output func(args []string) string
+	// Redact lists secrets to be masked in recorded steps.
+	Redact []string
+
+	mu     sync.Mutex
+	groups []string
+}
+
+type recordingCore struct {
+	Core
+	rec *Recorder
+}
+
+func (rec *Recorder) Command(name string, args ...string) *Cmd {
+	return Command(name, args...).Via(rec)
+}
+
+func (rec *Recorder) Run(cmd *exec.Cmd) error {
+	step := Step{Action: "run", Args: cmd.Args, Dir: cmd.Dir, Env: cmd.Env}
+
+	if cmd.Stdin != nil {
+		b, err := io.ReadAll(cmd.Stdin)
+		if err != nil {
+			return err
+		}
+		step.Input = string(b)
+	}
+
+	rec.Record(step)
+
+	if cmd.Stdout != nil && cmd.Stdout != os.Stdout {
+		out := fmt.Sprintf("$(%s)", strings.Join(cmd.Args[:min(2, len(cmd.Args))], " "))
+		if rec.Output != nil {
+			out = rec.Output(cmd.Args)
+		}
+
+		if _, err := io.WriteString(cmd.Stdout, out+"\n"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (rec *Recorder) Record(step Step) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	step.Group = strings.Join(rec.groups, " > ")
+	step.Args = rec.redact(step.Args)
+	step.Env = rec.redact(step.Env)
+	step.Input = rec.redact([]string{step.Input})[0]
+
+	rec.Steps = append(rec.Steps, step)
+}
+
+// Core returns a Core that attributes recorded steps to the current group.
+func (rec *Recorder) Core(core Core) Core {
+	return recordingCore{Core: core, rec: rec}
+}
+
+func (rec *Recorder) WriteText(w io.Writer) error {
+	var group string
+
+	for i, step := range rec.Steps {
+		if i == 0 || step.Group != group {
+			group = step.Group
+
+			header := "\n"
+			if group != "" {
+				header = fmt.Sprintf("\n# %s\n", group)
+			}
+
+			if _, err := io.WriteString(w, header); err != nil {
+				return err
+			}
+		}
+
+		var line string
+
+		switch step.Action {
+		case "run":
+			line = strings.Join(quote(step.Args), " ")
+
+			if len(step.Env) > 0 {
+				line = "env " + strings.Join(quote(step.Env), " ") + " " + line
+			}
+
+			if step.Dir != "" {
+				line = fmt.Sprintf("(cd %s && %s)", quote([]string{step.Dir})[0], line)
+			}
+
+		default:
+			line = fmt.Sprintf("%s %s", step.Action, step.Target)
+		}
+
+		if _, err := fmt.Fprintf(w, "%3d. %s\n", i+1, line); err != nil {
+			return err
+		}
+
+		for _, extra := range []string{step.Detail, step.Input} {
+			for l := range strings.Lines(strings.TrimRight(extra, "\n")) {
+				if _, err := fmt.Fprintf(w, "       | %s", strings.TrimSuffix(l, "\n")+"\n"); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (rec *Recorder) redact(s []string) []string {
+	if len(s) == 0 {
+		return s
+	}
+
+	out := make([]string, len(s))
+
+	for i, v := range s {
+		for _, secret := range rec.Redact {
+			if secret != "" {
+				v = strings.ReplaceAll(v, secret, "***")
+			}
+		}
+		out[i] = v
+	}
+
+	return out
+}
+
+func (rc recordingCore) Group(name string, fn func() error) error {
+	rc.rec.mu.Lock()
+	rc.rec.groups = append(rc.rec.groups, name)
+	rc.rec.mu.Unlock()
+
+	defer func() {
+		rc.rec.mu.Lock()
+		rc.rec.groups = rc.rec.groups[:len(rc.rec.groups)-1]
+		rc.rec.mu.Unlock()
+	}()
+
+	return rc.Core.Group(name, fn)
+}
+
+// Perform runs fn, unless r is a Recorder, in which case step is recorded
+// instead.
+func Perform(r Runner, step Step, fn func() error) error {
+	if rec, ok := r.(*Recorder); ok {
+		rec.Record(step)
+		return nil
+	}
+
+	return fn()
+}
+
+func quote(args []string) []string {
+	out := make([]string, len(args))
+
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'`$\\|&;<>(){}*?[]#~") {
+			arg = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+		out[i] = arg
+	}
+
+	return out
+}
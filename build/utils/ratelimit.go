@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RateLimited is a transport that waits out GitHub rate limits and retries,
+// reporting each wait through Core.
+type RateLimited struct {
+	Core      Core
+	Transport http.RoundTripper
+
+	// Retries is how many times a request is retried, and MaxWait the
+	// longest wait before giving up instead.
+	Retries int
+	MaxWait time.Duration
+}
+
+func (rl *RateLimited) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := rl.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+
+		wait, limited := rateLimitWait(resp, attempt)
+		if !limited {
+			return resp, nil
+		}
+
+		if attempt >= rl.Retries || wait > rl.MaxWait {
+			rl.Core.Error("GitHub rate limit exceeded for %s %s, giving up as it resets in %v", req.Method, req.URL.Path, wait.Round(time.Second))
+			return resp, nil
+		}
+
+		if req.Body != nil {
+			if req.GetBody == nil {
+				return resp, nil
+			}
+
+			body, err := req.GetBody()
+			if err != nil {
+				return resp, nil
+			}
+
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		resp.Body.Close()
+
+		rl.Core.Warning("GitHub rate limit exceeded for %s %s, retrying in %v", req.Method, req.URL.Path, wait.Round(time.Second))
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// rateLimitWait returns how long to wait before retrying, if resp says that a
+// primary or secondary rate limit was exceeded.
+func rateLimitWait(resp *http.Response, attempt int) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+
+	if s := resp.Header.Get("Retry-After"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil {
+			return time.Duration(n) * time.Second, true
+		}
+	}
+
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if n, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			return max(time.Until(time.Unix(n, 0)), 0) + time.Second, true
+		}
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || secondaryRateLimit(resp) {
+		// Secondary rate limits call for at least a minute, backing off
+		// exponentially.
+		return time.Minute << attempt, true
+	}
+
+	return 0, false
+}
+
+// secondaryRateLimit reports whether a 403 response is due to a secondary
+// rate limit, leaving its body intact.
+func secondaryRateLimit(resp *http.Response) bool {
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+
+	return err == nil && bytes.Contains(b, []byte("secondary rate limit"))
+}
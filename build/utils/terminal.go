@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TerminalCore prints to a terminal, indenting the output of groups. Groups
+// nest in the order they are opened, so goroutines that run at once must
+// open theirs through Flat, as Parallel does.
+type TerminalCore struct {
+	Verbose bool
+
+	flags *flag.FlagSet
+	out   io.Writer
+	color bool
+
+	mu    sync.Mutex
+	depth int
+}
+
+func NewTerminalCore(flags *flag.FlagSet) *TerminalCore {
+	return &TerminalCore{
+		flags: flags,
+		out:   os.Stderr,
+		color: os.Getenv("NO_COLOR") == "" && isTerminal(os.Stderr),
+	}
+}
+
+func (tc *TerminalCore) GetInput(name string) string {
+	if tc.flags == nil {
+		return ""
+	}
+
+	f := tc.flags.Lookup(name)
+	if f == nil {
+		return ""
+	}
+
+	return strings.TrimSpace(f.Value.String())
+}
+
+func (tc *TerminalCore) GetBoolInput(name string) bool {
+	b, _ := strconv.ParseBool(tc.GetInput(name))
+	return b
+}
+
+func (tc *TerminalCore) SetOutput(name, value string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	fmt.Printf("%s=%s\n", name, value)
+}
+
+func (tc *TerminalCore) Debug(format string, args ...any) {
+	if tc.Verbose {
+		tc.print(colorDim, "", format, args...)
+	}
+}
+
+func (tc *TerminalCore) Info(format string, args ...any) {
+	tc.print("", "", format, args...)
+}
+
+func (tc *TerminalCore) Warning(format string, args ...any) {
+	tc.print(colorYellow, "warning: ", format, args...)
+}
+
+func (tc *TerminalCore) Error(format string, args ...any) {
+	tc.print(colorRed, "error: ", format, args...)
+}
+
+func (tc *TerminalCore) Fail(format string, args ...any) {
+	tc.print(colorBoldRed, "failed: ", format, args...)
+}
+
+func (tc *TerminalCore) Group(name string, fn func() error) error {
+	tc.mu.Lock()
+	tc.write(colorBoldCyan, "▸ ", "%s", name)
+	tc.depth++
+	tc.mu.Unlock()
+
+	start := time.Now()
+	err := fn()
+	elapsed := time.Since(start).Round(time.Millisecond)
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	tc.depth--
+
+	if err != nil {
+		tc.write(colorRed, "✗ ", "%s (%v): %v", name, elapsed, err)
+	} else {
+		tc.write(colorGreen, "✓ ", "%s (%v)", name, elapsed)
+	}
+
+	return err
+}
+
+func (tc *TerminalCore) Guard(fn func() error) error {
+	return fn()
+}
+
+func (tc *TerminalCore) print(color, prefix, format string, args ...any) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	tc.write(color, prefix, format, args...)
+}
+
+// write prints a message at the current depth, with mu held.
+func (tc *TerminalCore) write(color, prefix, format string, args ...any) {
+	indent := strings.Repeat("  ", tc.depth)
+	msg := prefix + fmt.Sprintf(format, args...)
+
+	for line := range strings.Lines(msg) {
+		line = indent + strings.TrimSuffix(line, "\n")
+
+		if tc.color && color != "" {
+			line = color + line + colorReset
+		}
+
+		fmt.Fprintln(tc.out, line)
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+const (
+	colorReset    = "\x1b[0m"
+	colorDim      = "\x1b[2m"
+	colorRed      = "\x1b[31m"
+	colorGreen    = "\x1b[32m"
+	colorYellow   = "\x1b[33m"
+	colorBoldRed  = "\x1b[1;31m"
+	colorBoldCyan = "\x1b[1;36m"
+)
@@ -0,0 +1,241 @@
+package version
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/google/go-github/v74/github"
+)
+
+// prefetchBatch is how many repos are queried at once, which keeps each
+// query well within the GraphQL node limit.
+const prefetchBatch = 25
+
+// prefetched holds the releases and tags of repos as found by Prefetch, so
+// that RefVersion need not look them up one repo at a time.
+var prefetched struct {
+	sync.RWMutex
+	repos map[string]repoInfo
+}
+
+type repoInfo struct {
+	// Latest is the tag of the latest release, if any.
+	Latest   string
+	Releases []releaseInfo
+	// Tags are all tags of the repo, or nil if there are too many for one
+	// query, in which case RefVersion lists them all itself.
+	Tags []string
+}
+
+type releaseInfo struct {
+	Tag        string
+	Prerelease bool
+}
+
+type graphQLRepo struct {
+	LatestRelease *struct {
+		TagName string `json:"tagName"`
+	} `json:"latestRelease"`
+	Releases struct {
+		Nodes []struct {
+			TagName      string `json:"tagName"`
+			IsPrerelease bool   `json:"isPrerelease"`
+		} `json:"nodes"`
+	} `json:"releases"`
+	Refs struct {
+		Nodes []struct {
+			Name string `json:"name"`
+		} `json:"nodes"`
+		PageInfo struct {
+			HasNextPage bool `json:"hasNextPage"`
+		} `json:"pageInfo"`
+	} `json:"refs"`
+}
+
+// Prefetch looks up the latest releases and tags of the repos of refs through
+// the GraphQL API, many repos per query. Refs that need no lookup are
+// skipped. Repos that cannot be found are left to RefVersion to report.
+//
+// As with the REST API, the 100 most recently created releases are looked
+// up. Tags are only used if there are no more than 100, so that, again as
+// with the REST API, the latest version is chosen from all of them rather
+// than from a window that depends on how they are ordered.
+func Prefetch(gh *github.Client, refs []RepoRef) error {
+	var repos []string
+
+	for _, rr := range refs {
+		if rr.typ == RefNone || rr.typ == RefCommit || (rr.Ref != "" && rr.Ref != "@") {
+			continue
+		}
+
+		if !slices.Contains(repos, rr.Repo) {
+			repos = append(repos, rr.Repo)
+		}
+	}
+
+	slices.Sort(repos)
+
+	for batch := range slices.Chunk(repos, prefetchBatch) {
+		if err := prefetch(gh, batch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func prefetch(gh *github.Client, repos []string) error {
+	var params, fields []string
+	vars := make(map[string]any)
+
+	for i, name := range repos {
+		owner, repo, ok := strings.Cut(name, "/")
+		if !ok {
+			panic(fmt.Errorf("invalid repo: %q", name))
+		}
+
+		params = append(params, fmt.Sprintf("$o%d: String!, $n%d: String!", i, i))
+		fields = append(fields, fmt.Sprintf(`r%d: repository(owner: $o%d, name: $n%d) {
+  latestRelease { tagName }
+  releases(first: 100, orderBy: {field: CREATED_AT, direction: DESC}) { nodes { tagName isPrerelease } }
+  refs(refPrefix: "refs/tags/", first: 100) { nodes { name } pageInfo { hasNextPage } }
+}`, i, i, i))
+		vars[fmt.Sprintf("o%d", i)] = owner
+		vars[fmt.Sprintf("n%d", i)] = repo
+	}
+
+	query := fmt.Sprintf("query(%s) {\n%s\n}", strings.Join(params, ", "), strings.Join(fields, "\n"))
+
+	// GitHub Enterprise serves GraphQL next to, not under, the REST API.
+	endpoint := "graphql"
+	if strings.HasSuffix(gh.BaseURL.Path, "/api/v3/") {
+		endpoint = "../graphql"
+	}
+
+	req, err := gh.NewRequest("POST", endpoint, map[string]any{"query": query, "variables": vars})
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		Data   map[string]*graphQLRepo `json:"data"`
+		Errors []struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+
+	if _, err = gh.Do(context.TODO(), req, &resp); err != nil {
+		return err
+	}
+
+	for _, e := range resp.Errors {
+		// Missing repos are reported per repo, and are left to RefVersion.
+		if e.Type != "NOT_FOUND" {
+			return fmt.Errorf("GraphQL query failed: %s", e.Message)
+		}
+	}
+
+	prefetched.Lock()
+	defer prefetched.Unlock()
+
+	if prefetched.repos == nil {
+		prefetched.repos = make(map[string]repoInfo)
+	}
+
+	for i, name := range repos {
+		r := resp.Data[fmt.Sprintf("r%d", i)]
+		if r == nil {
+			continue
+		}
+
+		var info repoInfo
+
+		if r.LatestRelease != nil {
+			info.Latest = r.LatestRelease.TagName
+		}
+
+		for _, n := range r.Releases.Nodes {
+			info.Releases = append(info.Releases, releaseInfo{Tag: n.TagName, Prerelease: n.IsPrerelease})
+		}
+
+		if !r.Refs.PageInfo.HasNextPage {
+			for _, n := range r.Refs.Nodes {
+				info.Tags = append(info.Tags, n.Name)
+			}
+		}
+
+		prefetched.repos[name] = info
+	}
+
+	return nil
+}
+
+// prefetchedRefVersion is RefVersion as far as it can be answered from what
+// Prefetch found. Anything else, including failures, is left to RefVersion.
+func (rr RepoRef) prefetchedRefVersion() (ref, ver string, ok bool) {
+	prefetched.RLock()
+	info, ok := prefetched.repos[rr.Repo]
+	prefetched.RUnlock()
+
+	if !ok {
+		return
+	}
+
+	var tags []string
+
+	switch {
+	case rr.typ == RefTag:
+		tags = info.Tags
+
+	case (rr.Ref == "" && rr.regex == nil) || rr.Ref == "@":
+		if info.Latest == "" {
+			return "", "", false
+		}
+
+		ver, _, ok = rr.tagVersion(info.Latest)
+		return info.Latest, ver, ok
+
+	default:
+		for _, rls := range info.Releases {
+			if !rls.Prerelease {
+				tags = append(tags, rls.Tag)
+			}
+		}
+	}
+
+	var latest *semver.Version
+
+	for _, tag := range tags {
+		if v, sv, found := rr.tagVersion(tag); found && (latest == nil || sv.GreaterThan(latest)) {
+			ref, ver, latest = tag, v, sv
+		}
+	}
+
+	return ref, ver, latest != nil
+}
+
+// tagVersion returns the version in tag, which must be a strict semver.
+func (rr RepoRef) tagVersion(tag string) (string, *semver.Version, bool) {
+	ver := strings.TrimPrefix(tag, "v")
+
+	if rr.regex != nil {
+		m := rr.regex.FindStringSubmatch(tag)
+		if len(m) <= rr.index {
+			return "", nil, false
+		}
+
+		ver = m[rr.index]
+	}
+
+	sv, err := semver.StrictNewVersion(ver)
+	if err != nil {
+		return "", nil, false
+	}
+
+	return ver, sv, true
+}
@@ -6,8 +6,11 @@ import (
 	"regexp"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/Masterminds/semver/v3"
+	"github.com/cynix/freebsd-binaries/build/schema"
+	"github.com/enrichman/gh-iter/v74"
 	"github.com/goccy/go-yaml"
 	"github.com/google/go-github/v74/github"
 )
@@ -140,6 +143,10 @@ func (rr RepoRef) RefVersion(gh *github.Client) (string, string, error) {
 		return rr.Ref, ver, nil
 	}
 
+	if ref, ver, ok := rr.prefetchedRefVersion(); ok {
+		return ref, ver, nil
+	}
+
 	if rr.typ == RefRelease {
 		rls, ver, err := rr.ReleaseVersion(gh)
 		if err != nil {
@@ -165,12 +172,11 @@ func (rr RepoRef) RefVersion(gh *github.Client) (string, string, error) {
 	}
 	var found []tagVersion
 
-	tags, _, err := gh.Repositories.ListTags(context.TODO(), owner, repo, &github.ListOptions{PerPage: 100})
-	if err != nil {
-		return "", "", err
-	}
+	// Every tag is considered, since those with the latest versions are not
+	// necessarily listed first.
+	tags := ghiter.NewFromFn2(gh.Repositories.ListTags, owner, repo).Opts(&github.ListOptions{PerPage: 100})
 
-	for _, tag := range tags {
+	for tag := range tags.All() {
 		tv := tagVersion{Tag: *tag.Name}
 
 		if rr.regex != nil {
@@ -192,6 +198,10 @@ func (rr RepoRef) RefVersion(gh *github.Client) (string, string, error) {
 		found = append(found, tv)
 	}
 
+	if err := tags.Err(); err != nil {
+		return "", "", err
+	}
+
 	if len(found) == 0 {
 		return "", "", fmt.Errorf("no matching tag found in %q: %q", rr.Repo, rr.regex)
 	}
@@ -297,13 +307,75 @@ func (rr RepoRef) ReleaseVersion(gh *github.Client) (rls *github.RepositoryRelea
 	return found[0].Release, found[0].Version, nil
 }
 
-func (rr *RepoRef) UnmarshalYAML(b []byte) (err error) {
-	var raw struct {
-		Repo    string
-		Ref     string
-		Version VersionConfig
+// Regex returns the regex that tags are matched against, if any.
+func (rr RepoRef) Regex() *regexp.Regexp {
+	return rr.regex
+}
+
+// RefDate returns when ref, as returned by RefVersion, was released or
+// committed.
+func (rr RepoRef) RefDate(gh *github.Client, ref string) (time.Time, error) {
+	owner, repo, ok := strings.Cut(rr.Repo, "/")
+	if !ok {
+		panic(fmt.Errorf("invalid repo: %q", rr.Repo))
+	}
+
+	if rr.typ == RefRelease {
+		rls, _, err := gh.Repositories.GetReleaseByTag(context.TODO(), owner, repo, ref)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		return rls.GetPublishedAt().Time, nil
+	}
+
+	commit, _, err := gh.Repositories.GetCommit(context.TODO(), owner, repo, ref, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return commit.GetCommit().GetCommitter().GetDate().Time, nil
+}
+
+// CommitsBehind returns how many commits the default branch is ahead of a
+// pinned commit, and when the oldest of them was committed. It returns zero
+// for refs that are not pinned to a commit.
+func (rr RepoRef) CommitsBehind(gh *github.Client) (n int, since time.Time, err error) {
+	if rr.typ != RefCommit {
+		return
 	}
 
+	owner, repo, ok := strings.Cut(rr.Repo, "/")
+	if !ok {
+		panic(fmt.Errorf("invalid repo: %q", rr.Repo))
+	}
+
+	var r *github.Repository
+	if r, _, err = gh.Repositories.Get(context.TODO(), owner, repo); err != nil {
+		return
+	}
+
+	var cmp *github.CommitsComparison
+	if cmp, _, err = gh.Repositories.CompareCommits(context.TODO(), owner, repo, rr.Ref, r.GetDefaultBranch(), &github.ListOptions{PerPage: 1}); err != nil {
+		return
+	}
+
+	if n = cmp.GetAheadBy(); n > 0 && len(cmp.Commits) > 0 {
+		since = cmp.Commits[0].GetCommit().GetCommitter().GetDate().Time
+	}
+
+	return
+}
+
+type rawRepoRef struct {
+	Repo    string
+	Ref     string
+	Version VersionConfig
+}
+
+func (rr *RepoRef) UnmarshalYAML(b []byte) (err error) {
+	var raw rawRepoRef
+
 	if err = yaml.Unmarshal(b, &raw.Repo); err != nil {
 		if err = yaml.UnmarshalWithOptions(b, &raw, yaml.DisallowUnknownField()); err != nil {
 			return
@@ -323,11 +395,7 @@ func (rr *RepoRef) UnmarshalYAML(b []byte) (err error) {
 }
 
 func (rr *ReleaseRef) UnmarshalYAML(b []byte) (err error) {
-	var raw struct {
-		Repo    string
-		Ref     string
-		Version VersionConfig
-	}
+	var raw rawRepoRef
 
 	if err = yaml.Unmarshal(b, &raw.Repo); err != nil {
 		if err = yaml.UnmarshalWithOptions(b, &raw, yaml.DisallowUnknownField()); err != nil {
@@ -347,6 +415,41 @@ func (rr *ReleaseRef) UnmarshalYAML(b []byte) (err error) {
 	return
 }
 
+// MarshalYAML returns rr in the form it is configured. Release refs need no
+// prefix, which suits ReleaseRef too.
+func (rr RepoRef) MarshalYAML() (any, error) {
+	raw := rawRepoRef{Repo: rr.Repo, Ref: rr.Ref, Version: rr.Version}
+
+	if rr.regex != nil {
+		raw.Ref += "/" + rr.regex.String() + "/"
+	}
+
+	switch {
+	case rr.typ == RefTag && raw.Ref == "":
+		raw.Ref = "tag"
+	case rr.typ == RefTag:
+		raw.Ref = "tag:" + raw.Ref
+	case rr.typ == RefCommit:
+		raw.Ref = "commit:" + raw.Ref
+	}
+
+	return raw, nil
+}
+
+func (rr *RepoRef) JSONSchema(g *schema.Generator) *schema.Schema {
+	raw := g.Struct(rawRepoRef{})
+	raw.Properties["repo"].Pattern = repoPattern
+	raw.Properties["ref"].Description = "Tag or release, optionally prefixed with release:, tag: or commit:, and optionally followed by /regex/"
+	raw.Required = []string{"repo"}
+
+	return schema.OneOf(
+		&schema.Schema{Type: "string", Pattern: repoPattern, Description: "GitHub repo, using its latest release"},
+		raw,
+	)
+}
+
+const repoPattern = "^[^/]+/[^/]+$"
+
 var (
 	commitRegex = regexp.MustCompile("^[0-9a-f]{1,40}$")
 )
@@ -7,9 +7,13 @@ import (
 	"regexp"
 	"strings"
 
+	"github.com/cynix/freebsd-binaries/build/schema"
 	"github.com/goccy/go-yaml"
 )
 
+// HTTPClient fetches versions from URLs.
+var HTTPClient = http.DefaultClient
+
 type VersionConfig struct {
 	version string
 	regex   *regexp.Regexp
@@ -29,7 +33,7 @@ func (v VersionConfig) Resolve() (string, error) {
 }
 
 func (v VersionConfig) get() (string, error) {
-	r, err := http.Get(v.version)
+	r, err := HTTPClient.Get(v.version)
 	if err != nil {
 		return "", err
 	}
@@ -61,6 +65,11 @@ func (v VersionConfig) get() (string, error) {
 	return m[i], nil
 }
 
+type rawVersionConfig struct {
+	URL   string
+	Regex string
+}
+
 func (v *VersionConfig) UnmarshalYAML(b []byte) error {
 	var s string
 
@@ -69,10 +78,7 @@ func (v *VersionConfig) UnmarshalYAML(b []byte) error {
 		return nil
 	}
 
-	var raw struct {
-		URL   string
-		Regex string
-	}
+	var raw rawVersionConfig
 
 	if yaml.UnmarshalWithOptions(b, &raw, yaml.DisallowUnknownField()) == nil {
 		if raw.URL == "" || !strings.HasPrefix(raw.URL, "https://") {
@@ -101,3 +107,23 @@ func (v *VersionConfig) UnmarshalYAML(b []byte) error {
 
 	return fmt.Errorf("invalid version config")
 }
+
+func (v VersionConfig) MarshalYAML() (any, error) {
+	if v.regex == nil {
+		return v.version, nil
+	}
+
+	return rawVersionConfig{URL: v.version, Regex: v.regex.String()}, nil
+}
+
+func (v *VersionConfig) JSONSchema(g *schema.Generator) *schema.Schema {
+	raw := g.Struct(rawVersionConfig{})
+	raw.Properties["url"].Pattern = "^https://"
+	raw.Properties["regex"].Description = "Regex with a named group \"version\" to extract the version from the response"
+	raw.Required = []string{"url"}
+
+	return schema.OneOf(
+		&schema.Schema{Type: "string", Description: "Literal version, or https:// URL that returns the version"},
+		raw,
+	)
+}